@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"monitoring-agent-client/internal/compat"
+	"monitoring-agent-client/internal/nagios"
+	"strconv"
+	"strings"
+)
+
+const (
+	aggregateWorst   = "worst"
+	aggregateBest    = "best"
+	aggregateAtLeast = "atleast"
+	aggregatePercent = "percent"
+)
+
+// aggregationPolicy decides the state of a check run against several hosts
+// from the states of the hosts
+type aggregationPolicy struct {
+	name string
+	// minimum is the number of hosts for atleast and the percentage for
+	// percent that must be OK
+	minimum int
+	// unreachableState replaces the state of hosts that could not be
+	// contacted when unreachableSet
+	unreachableState int
+	unreachableSet   bool
+}
+
+// parseAggregationPolicy reads worst, best, atleast:<hosts> or
+// percent:<percentage>, and the state unreachable hosts count as when set
+func parseAggregationPolicy(value string, unreachableState string) (aggregationPolicy, error) {
+	var policy aggregationPolicy
+
+	name, argument, hasArgument := compat.Cut(strings.ToLower(strings.TrimSpace(value)), ":")
+	policy.name = name
+	switch name {
+	case aggregateWorst, aggregateBest:
+		if hasArgument {
+			return policy, fmt.Errorf("invalid aggregation %q, %s does not take an argument", value, name)
+		}
+	case aggregateAtLeast, aggregatePercent:
+		minimum, err := strconv.Atoi(argument)
+		if !hasArgument || err != nil || minimum < 1 || (name == aggregatePercent && minimum > 100) {
+			return policy, fmt.Errorf("invalid aggregation %q, expected atleast:<hosts> or percent:<1-100>", value)
+		}
+		policy.minimum = minimum
+	default:
+		return policy, fmt.Errorf("invalid aggregation %q, expected worst, best, atleast:<hosts> or percent:<percentage>", value)
+	}
+
+	if unreachableState != "" {
+		state, err := parseState(unreachableState)
+		if err != nil {
+			return policy, fmt.Errorf("invalid unreachable state: %s", err)
+		}
+		policy.unreachableState = state
+		policy.unreachableSet = true
+	}
+
+	return policy, nil
+}
+
+// checkHosts rejects an atleast policy that needs more OK hosts than there
+// are hosts, the check could never be OK
+func (policy aggregationPolicy) checkHosts(total int) error {
+	if policy.name == aggregateAtLeast && policy.minimum > total {
+		return fmt.Errorf("-aggregate atleast:%d needs more OK hosts than the %d hosts given", policy.minimum, total)
+	}
+	return nil
+}
+
+// countedState is the state a host's result contributes to the aggregate
+func (policy aggregationPolicy) countedState(result hostResult) int {
+	if policy.unreachableSet && result.failure.unreachable() {
+		return policy.unreachableState
+	}
+	return result.state
+}
+
+// requiredOK is the number of OK hosts the atleast and percent policies need
+// out of total
+func (policy aggregationPolicy) requiredOK(total int) int {
+	if policy.name == aggregatePercent {
+		return int(math.Ceil(float64(policy.minimum*total) / 100))
+	}
+	return policy.minimum
+}
+
+// aggregateResults reports the state decided by the policy with a count of
+// each state on the first line and in the perfdata, and every host's output
+// in the long output. The hosts' perfdata is left out as the same labels
+// would repeat for each host.
+func aggregateResults(results []hostResult, policy aggregationPolicy) (string, int) {
+	counts := map[int]int{}
+	states := make([]int, len(results))
+	for index, result := range results {
+		states[index] = policy.countedState(result)
+		counts[states[index]]++
+	}
+
+	state := states[0]
+	for _, hostState := range states[1:] {
+		switch policy.name {
+		case aggregateBest:
+			if stateSeverity[hostState] < stateSeverity[state] {
+				state = hostState
+			}
+		default:
+			state = worstState(state, hostState)
+		}
+	}
+
+	summary := []string{fmt.Sprintf("%d hosts", len(results))}
+	for _, countedState := range []int{okExitCode, warningExitCode, criticalExitCode, unknownExitCode} {
+		if counts[countedState] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[countedState], stateNames[countedState]))
+		}
+	}
+
+	okThreshold := ""
+	switch policy.name {
+	case aggregateAtLeast, aggregatePercent:
+		required := policy.requiredOK(len(results))
+		state = okExitCode
+		if counts[okExitCode] < required {
+			state = criticalExitCode
+		}
+		okThreshold = fmt.Sprintf("%d:", required)
+		if policy.name == aggregatePercent {
+			summary = append(summary, fmt.Sprintf("at least %d%% OK required", policy.minimum))
+		} else {
+			summary = append(summary, fmt.Sprintf("at least %d OK required", required))
+		}
+	}
+
+	aggregated := nagios.Output{Text: fmt.Sprintf("%s - %s", stateNames[state], strings.Join(summary, ", "))}
+	for _, countedState := range []int{okExitCode, warningExitCode, criticalExitCode, unknownExitCode} {
+		perfdata := nagios.Perfdata{
+			Label: strings.ToLower(stateNames[countedState]),
+			Value: strconv.Itoa(counts[countedState]),
+			Min:   "0",
+			Max:   strconv.Itoa(len(results)),
+		}
+		if countedState == okExitCode {
+			perfdata.Critical = okThreshold
+		}
+		aggregated.Perfdata = append(aggregated.Perfdata, perfdata)
+	}
+
+	for index, result := range results {
+		text, longOutput := hostOutputLines(result.output)
+		aggregated.LongOutput = append(aggregated.LongOutput, fmt.Sprintf("[%s] %s: %s", stateNames[states[index]], result.address, text))
+		for _, line := range longOutput {
+			aggregated.LongOutput = append(aggregated.LongOutput, "  "+line)
+		}
+	}
+
+	return aggregated.String(), state
+}
+
+// hostOutputLines splits a host's output into its first line and long output
+// without the perfdata, perfdata that cannot be parsed is dropped along with
+// the rest
+func hostOutputLines(output string) (string, []string) {
+	parsed, _ := nagios.ParseOutput(output)
+	return parsed.Text, parsed.LongOutput
+}
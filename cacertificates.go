@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// caCertificateExtensions are the files read from a -cadir, anything else,
+// such as the hash links c_rehash leaves, is skipped
+var caCertificateExtensions = map[string]bool{".pem": true, ".crt": true, ".cer": true}
+
+// systemCertPoolAvailable is false on Windows, where x509.SystemCertPool
+// always fails before Go 1.18
+var systemCertPoolAvailable = runtime.GOOS != "windows"
+
+// caCertificatePool builds the pool the agents' certificates are verified
+// against, nil when nothing is configured so Go uses the system roots
+func caCertificatePool(files []string, directory string, system bool) (*x509.CertPool, error) {
+	if len(files) == 0 && directory == "" {
+		return nil, nil
+	}
+
+	pool := x509.NewCertPool()
+	if system && !systemCertPoolAvailable {
+		return nil, fmt.Errorf("-ca-system is not supported on Windows, leave out -cacert and -cadir to verify against the system's CA certificates")
+	}
+	if system {
+		systemPool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("error loading the system CA certificates: %s", err)
+		}
+		pool = systemPool
+	}
+
+	if directory != "" {
+		entries, err := ioutil.ReadDir(directory)
+		if err != nil {
+			return nil, fmt.Errorf("error loading ca certificate %s", err.Error())
+		}
+		var directoryFiles []string
+		for _, entry := range entries {
+			if !entry.IsDir() && caCertificateExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+				directoryFiles = append(directoryFiles, filepath.Join(directory, entry.Name()))
+			}
+		}
+		if len(directoryFiles) == 0 {
+			return nil, fmt.Errorf("no certificates found in %s, expected .pem, .crt or .cer files", directory)
+		}
+		sort.Strings(directoryFiles)
+		files = append(files, directoryFiles...)
+	}
+
+	for _, file := range files {
+		caCertificate, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error loading ca certificate %s", err.Error())
+		}
+		if !pool.AppendCertsFromPEM(caCertificate) {
+			return nil, fmt.Errorf("no certificates found in %s", file)
+		}
+	}
+	return pool, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"monitoring-agent-client/internal/nagios"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// certificateCheck reports on the certificates an agent presents, and the
+// client certificate, instead of running anything on the agent. knownAgents is
+// set with -tofu, the agent's key is then compared with the recorded one
+// instead of validating the chain.
+type certificateCheck struct {
+	transport    *http.Transport
+	timeouts     clientTimeouts
+	insecure     bool
+	pinned       bool
+	knownAgents  *knownAgents
+	warningDays  int
+	criticalDays int
+	errorStates  failureStates
+}
+
+// certificateStatus collects the problems found and the long output while
+// checking certificates
+type certificateStatus struct {
+	state    int
+	problems []string
+	lines    []string
+}
+
+func (status *certificateStatus) problem(state int, message string) {
+	status.state = worstState(status.state, state)
+	status.problems = append(status.problems, message)
+}
+
+// run connects to the agent at address and reports its certificate chain
+func (check *certificateCheck) run(address string) hostResult {
+	ctx, cancel := context.WithTimeout(context.Background(), check.timeouts.total)
+	defer cancel()
+
+	connection, err := check.transport.DialContext(ctx, "tcp", address)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return check.failed(address, timeoutFailure("client", check.timeouts.total, address, phaseDial))
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return check.failed(address, timeoutFailure(phaseDial.timeoutName(), check.timeouts.connect, address, phaseDial))
+		}
+		return check.failed(address, classifyTransportError(err, address))
+	}
+	defer connection.Close()
+
+	host, _, _ := net.SplitHostPort(address)
+
+	// the chain is verified below so that an invalid certificate is still
+	// reported on rather than failing the handshake
+	config := check.transport.TLSClientConfig.Clone()
+	config.InsecureSkipVerify = true
+	if config.ServerName != "" {
+		host = config.ServerName
+	}
+	config.ServerName = host
+
+	handshakeCtx := ctx
+	if check.timeouts.tls > 0 {
+		var cancelHandshake context.CancelFunc
+		handshakeCtx, cancelHandshake = context.WithTimeout(ctx, check.timeouts.tls)
+		defer cancelHandshake()
+	}
+
+	tlsConnection := tls.Client(connection, config)
+	if err := tlsConnection.HandshakeContext(handshakeCtx); err != nil {
+		if handshakeCtx.Err() == context.DeadlineExceeded {
+			return check.failed(address, timeoutFailure(phaseTLS.timeoutName(), check.timeouts.forPhase(phaseTLS), address, phaseTLS))
+		}
+		return check.failed(address, failure{class: failureTLS, message: fmt.Sprintf("TLS handshake with %s failed: %s", address, err)})
+	}
+
+	connectionState := tlsConnection.ConnectionState()
+	chain := connectionState.PeerCertificates
+	if len(chain) == 0 {
+		return check.failed(address, failure{class: failureTLS, message: fmt.Sprintf("%s did not present a certificate", address)})
+	}
+
+	now := time.Now()
+	status := &certificateStatus{state: okExitCode}
+	status.lines = append(status.lines, fmt.Sprintf("negotiated %s with %s", tlsVersionName(connectionState.Version), tls.CipherSuiteName(connectionState.CipherSuite)))
+
+	switch {
+	case check.knownAgents != nil:
+		check.compareKnownAgent(status, address, chain[0])
+	case check.pinned:
+		// a mismatch fails the handshake above
+		status.lines = append(status.lines, "the certificate matches a -pin, the chain was not validated")
+	case check.insecure:
+		status.lines = append(status.lines, "the chain was not validated, -insecure is set")
+	default:
+		if err := verifyChain(chain, check.transport.TLSClientConfig.RootCAs, host, now); err != nil {
+			// expiry is reported with the days remaining below
+			var invalidError x509.CertificateInvalidError
+			if !errors.As(err, &invalidError) || invalidError.Reason != x509.Expired {
+				status.problem(criticalExitCode, fmt.Sprintf("certificate of %s does not validate: %s", address, err))
+			}
+		}
+	}
+
+	agentDays := math.MaxInt32
+	for index, certificate := range chain {
+		kind := "chain certificate"
+		if index == 0 {
+			kind = "agent certificate"
+			status.lines = append(status.lines, fmt.Sprintf("agent certificate pin: %s", publicKeyPin(certificate)))
+		}
+		days := check.expiry(status, kind, certificate, now)
+		if days < agentDays {
+			agentDays = days
+		}
+	}
+	perfdata := []nagios.Perfdata{check.daysPerfdata("agent_cert_days", agentDays)}
+
+	clientDays, hasClientCertificate := check.clientCertificateDays(status, now)
+	if hasClientCertificate {
+		perfdata = append(perfdata, check.daysPerfdata("client_cert_days", clientDays))
+	}
+
+	text := strings.Join(status.problems, ", ")
+	if len(status.problems) == 0 {
+		text = fmt.Sprintf("certificates of %s valid for %d days", address, agentDays)
+		if hasClientCertificate {
+			text += fmt.Sprintf(", client certificate for %d days", clientDays)
+		}
+	}
+
+	output := nagios.Output{
+		Text:       fmt.Sprintf("%s - %s", stateNames[status.state], text),
+		LongOutput: status.lines,
+		Perfdata:   perfdata,
+	}
+	return hostResult{address: address, output: output.String(), state: status.state}
+}
+
+// compareKnownAgent reports whether the agent's key matches the one recorded
+// by -tofu, an agent that is not recorded yet is left for the first check to
+// record so its pin can be added by hand first
+func (check *certificateCheck) compareKnownAgent(status *certificateStatus, address string, certificate *x509.Certificate) {
+	entries, err := check.knownAgents.read()
+	if err != nil {
+		status.problem(unknownExitCode, err.Error())
+		return
+	}
+	presented := publicKeyPin(certificate)
+	known, found := entries[address]
+	switch {
+	case !found:
+		status.lines = append(status.lines, fmt.Sprintf("%s is not in %s yet, the chain was not validated, -tofu is set", address, check.knownAgents.path))
+	case samePublicKeyPin(known, presented):
+		status.lines = append(status.lines, fmt.Sprintf("the certificate matches %s, the chain was not validated, -tofu is set", check.knownAgents.path))
+	default:
+		mismatch := knownAgentMismatchError{address: address, known: known, presented: presented, path: check.knownAgents.path}
+		status.problem(check.errorStates.stateFor(failureKnownAgent), mismatch.Error())
+	}
+}
+
+// clientCertificateDays checks the -certificate, the certificate is the same
+// for every agent but is reported with each so every result is complete
+func (check *certificateCheck) clientCertificateDays(status *certificateStatus, now time.Time) (int, bool) {
+	certificates := check.transport.TLSClientConfig.Certificates
+	if len(certificates) == 0 || len(certificates[0].Certificate) == 0 {
+		return 0, false
+	}
+	certificate, err := x509.ParseCertificate(certificates[0].Certificate[0])
+	if err != nil {
+		status.problem(unknownExitCode, fmt.Sprintf("could not parse the client certificate: %s", err))
+		return 0, false
+	}
+	return check.expiry(status, "client certificate", certificate, now), true
+}
+
+// expiry describes the certificate in the long output and raises a problem
+// when it expires within the warning or critical days
+func (check *certificateCheck) expiry(status *certificateStatus, kind string, certificate *x509.Certificate, now time.Time) int {
+	days := int(math.Floor(certificate.NotAfter.Sub(now).Hours() / 24))
+
+	description := fmt.Sprintf("%s: %s", kind, certificate.Subject)
+	if names := subjectAlternativeNames(certificate); len(names) > 0 {
+		description += fmt.Sprintf(", SANs: %s", strings.Join(names, ", "))
+	}
+	description += fmt.Sprintf(", issuer: %s, expires %s (%d days)", certificate.Issuer, certificate.NotAfter.UTC().Format("2006-01-02"), days)
+	status.lines = append(status.lines, description)
+
+	name := certificate.Subject.CommonName
+	if name == "" {
+		name = certificate.Subject.String()
+	}
+	switch {
+	case days < 0:
+		status.problem(criticalExitCode, fmt.Sprintf("%s %q expired %d days ago", kind, name, -days))
+	case days < check.criticalDays:
+		status.problem(criticalExitCode, fmt.Sprintf("%s %q expires in %d days", kind, name, days))
+	case days < check.warningDays:
+		status.problem(warningExitCode, fmt.Sprintf("%s %q expires in %d days", kind, name, days))
+	}
+	return days
+}
+
+func (check *certificateCheck) daysPerfdata(label string, days int) nagios.Perfdata {
+	return nagios.Perfdata{
+		Label:    label,
+		Value:    strconv.Itoa(days),
+		Warning:  fmt.Sprintf("%d:", check.warningDays),
+		Critical: fmt.Sprintf("%d:", check.criticalDays),
+	}
+}
+
+func (check *certificateCheck) failed(address string, problem failure) hostResult {
+	output, state := problem.render(check.errorStates)
+	return hostResult{address: address, output: output, state: state, failure: problem.class}
+}
+
+// verifyChain validates the presented chain the way the TLS handshake would,
+// against the system roots when roots is nil
+func verifyChain(chain []*x509.Certificate, roots *x509.CertPool, host string, now time.Time) error {
+	intermediates := x509.NewCertPool()
+	for _, certificate := range chain[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       host,
+		CurrentTime:   now,
+	})
+	return err
+}
+
+func subjectAlternativeNames(certificate *x509.Certificate) []string {
+	names := append([]string{}, certificate.DNSNames...)
+	for _, address := range certificate.IPAddresses {
+		names = append(names, address.String())
+	}
+	return names
+}
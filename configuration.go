@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monitoring-agent-client/internal/config"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// applyConfiguration fills every flag that was not given on the command line
+// from the -agent and -check profiles, a -group replaces the agent's host with
+// the group's hosts. The environment variables are the flag
+// defaults so the precedence is: flag, config file, environment, default.
+// The check's script arguments are returned for use when none were passed
+// after the flags, and the config file for the agents' own credentials.
+func applyConfiguration(flags *flag.FlagSet, configFilePath string, agentName string, checkName string, groupName string) ([]string, *config.Config, error) {
+	if configFilePath == "" {
+		if agentName != "" || checkName != "" || groupName != "" {
+			return nil, nil, fmt.Errorf("-agent, -check and -group require -config")
+		}
+		return nil, nil, nil
+	}
+
+	configuration, err := config.Load(configFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configured := map[string][]string{
+		"minisign-pubkey": nonEmpty(configuration.MinisignPublicKey),
+		"known-agents":    nonEmpty(configuration.KnownAgents),
+	}
+	var defaultScriptArguments []string
+
+	for class, state := range configuration.ErrorStates {
+		configured["error-state"] = append(configured["error-state"], class+"="+state)
+	}
+
+	if agentName != "" {
+		agent, err := configuration.Agent(agentName)
+		if err != nil {
+			return nil, nil, err
+		}
+		configured["host"] = nonEmpty(agent.Host)
+		if agent.Port != 0 {
+			configured["port"] = []string{strconv.Itoa(agent.Port)}
+		}
+		configured["cacert"] = agent.CACert
+		configured["cadir"] = nonEmpty(agent.CADirectory)
+		if agent.CASystem {
+			configured["ca-system"] = []string{"true"}
+		}
+		configured["certificate"] = nonEmpty(agent.Certificate)
+		configured["key"] = nonEmpty(agent.Key)
+		configured["key-passphrase-file"] = nonEmpty(agent.KeyPassphraseFile)
+		configured["key-passphrase-command"] = nonEmpty(agent.KeyPassphraseCommand)
+		configured["pin"] = agent.Pins
+		configured["servername"] = nonEmpty(agent.ServerName)
+		configured["tls-min-version"] = nonEmpty(agent.TLSMinVersion)
+		configured["tls-max-version"] = nonEmpty(agent.TLSMaxVersion)
+		configured["tls-ciphers"] = nonEmpty(strings.Join(agent.TLSCiphers, ","))
+		configured["tls-curves"] = nonEmpty(strings.Join(agent.TLSCurves, ","))
+		if agent.Tofu {
+			configured["tofu"] = []string{"true"}
+		}
+		if agent.Insecure {
+			configured["insecure"] = []string{"true"}
+		}
+		configured["username"] = nonEmpty(agent.Username)
+		configured["password"] = nonEmpty(agent.Password)
+		if agent.PasswordEnv != "" {
+			configured["password"] = nonEmpty(os.Getenv(agent.PasswordEnv))
+		}
+		configured["password-file"] = nonEmpty(agent.PasswordFile)
+		configured["credential-helper"] = nonEmpty(agent.CredentialHelper)
+	}
+
+	if groupName != "" {
+		hosts, err := configuration.Group(groupName)
+		if err != nil {
+			return nil, nil, err
+		}
+		configured["host"] = hosts
+	}
+
+	if checkName != "" {
+		check, err := configuration.Check(checkName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if check.Probe {
+			configured["probe"] = []string{"true"}
+		}
+		if check.CheckCerts {
+			configured["check-certs"] = []string{"true"}
+		}
+		if check.CertWarning != nil {
+			configured["cert-warning"] = []string{strconv.Itoa(*check.CertWarning)}
+		}
+		if check.CertCritical != nil {
+			configured["cert-critical"] = []string{strconv.Itoa(*check.CertCritical)}
+		}
+		configured["mode"] = nonEmpty(check.Mode)
+		configured["script"] = nonEmpty(check.Script)
+		configured["interpreter"] = nonEmpty(check.Interpreter)
+		configured["executable"] = nonEmpty(check.Executable)
+		configured["executableArg"] = check.ExecutableArgs
+		configured["timeout"] = nonEmpty(check.Timeout)
+		configured["aggregate"] = nonEmpty(check.Aggregate)
+		configured["unreachable-state"] = nonEmpty(check.UnreachableState)
+		for exitCode, state := range check.ExitCodeMap {
+			configured["exit-code-map"] = append(configured["exit-code-map"], exitCode+"="+state)
+		}
+		for label, threshold := range check.Warning {
+			configured["warning"] = append(configured["warning"], label+"="+threshold)
+		}
+		for label, threshold := range check.Critical {
+			configured["critical"] = append(configured["critical"], label+"="+threshold)
+		}
+		if check.Invert {
+			configured["invert"] = []string{"true"}
+		}
+		if check.PrefixState {
+			configured["prefix-state"] = []string{"true"}
+		}
+		defaultScriptArguments = check.ScriptArgs
+	}
+
+	setOnCommandLine := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	for name, values := range configured {
+		if setOnCommandLine[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := flags.Set(name, value); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s value %q in config file: %s", name, value, err)
+			}
+		}
+	}
+
+	return defaultScriptArguments, configuration, nil
+}
+
+func nonEmpty(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"monitoring-agent-client/internal/compat"
+	"monitoring-agent-client/internal/config"
+	"net"
+	"os"
+	"strings"
+)
+
+// stdin is read by -password-stdin
+var stdin io.Reader = os.Stdin
+
+// credentialSource is where the username and password for an agent come from,
+// a password file or credential helper is used over the password
+type credentialSource struct {
+	username     string
+	password     string
+	passwordFile string
+	helper       string
+}
+
+func (source credentialSource) configured() bool {
+	return source.password != "" || source.passwordFile != "" || source.helper != ""
+}
+
+// credentials resolves the username and password for each agent, agents in
+// the config file have their own by host and the flags are used for the rest.
+// Flags given on the command line still take precedence over the config file.
+type credentials struct {
+	defaults credentialSource
+	hosts    map[string]credentialSource
+	// usernameFlag and passwordFlag are set when the username or a password
+	// source was given on the command line
+	usernameFlag bool
+	passwordFlag bool
+}
+
+// hostCredentials reads the credentials of the config file's agents by their
+// host, and by host:port when the agent sets a port
+func hostCredentials(configuration *config.Config) (map[string]credentialSource, error) {
+	hosts := map[string]credentialSource{}
+	if configuration == nil {
+		return hosts, nil
+	}
+	for name := range configuration.Agents {
+		agent, err := configuration.Agent(name)
+		if err != nil {
+			return nil, err
+		}
+		source := credentialSource{
+			username:     agent.Username,
+			password:     agent.Password,
+			passwordFile: agent.PasswordFile,
+			helper:       agent.CredentialHelper,
+		}
+		if agent.PasswordEnv != "" {
+			source.password = os.Getenv(agent.PasswordEnv)
+		}
+		if source.username == "" && !source.configured() {
+			continue
+		}
+		host := agent.Host
+		if agent.Port != 0 {
+			host = net.JoinHostPort(agent.Host, fmt.Sprint(agent.Port))
+		}
+		hosts[host] = source
+	}
+	return hosts, nil
+}
+
+// passwordSourceFlags are the flags giving the password, only one is used
+var passwordSourceFlags = []string{"password", "password-file", "password-stdin", "credential-helper"}
+
+// selectPasswordSources picks the password flags to use with the usual
+// precedence: those given on the command line, then those from the config
+// file, nil leaves it to the environment variables. Only flags given together
+// on the command line conflict, a lower precedence source is overridden.
+func selectPasswordSources(setOnCommandLine map[string]bool, setByConfiguration map[string]bool) (map[string]bool, error) {
+	selected := setFlags(setOnCommandLine, passwordSourceFlags)
+	if len(selected) > 1 {
+		return nil, fmt.Errorf("only one of -password, -password-file, -password-stdin and -credential-helper can be set")
+	}
+	if len(selected) == 0 {
+		selected = setFlags(setByConfiguration, passwordSourceFlags)
+	}
+	if len(selected) == 0 {
+		return nil, nil
+	}
+	return selected, nil
+}
+
+// setFlags returns which of names are in set
+func setFlags(set map[string]bool, names []string) map[string]bool {
+	found := map[string]bool{}
+	for _, name := range names {
+		if set[name] {
+			found[name] = true
+		}
+	}
+	return found
+}
+
+// readPasswordStdin reads the password from the first line of stdin
+func readPasswordStdin() (string, error) {
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("error reading the password from stdin: %s", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// source is the agent's own credentials from the config file, with anything
+// it does not set taken from the flags
+func (c *credentials) source(address string) credentialSource {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	source, found := c.hosts[address]
+	if !found {
+		source, found = c.hosts[host]
+	}
+	if !found {
+		return c.defaults
+	}
+	if source.username == "" || c.usernameFlag {
+		source.username = c.defaults.username
+	}
+	if !source.configured() || c.passwordFlag {
+		source.password = c.defaults.password
+		source.passwordFile = c.defaults.passwordFile
+		source.helper = c.defaults.helper
+	}
+	return source
+}
+
+// configured is false when there is no password for the agent at address
+func (c *credentials) configured(address string) bool {
+	return c.source(address).configured()
+}
+
+// lookup returns the username and password to send to the agent at address
+func (c *credentials) lookup(address string) (string, string, error) {
+	source := c.source(address)
+	switch {
+	case source.passwordFile != "":
+		content, err := ioutil.ReadFile(source.passwordFile)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading the password: %s", err)
+		}
+		return source.username, string(trimLineEnding(content)), nil
+	case source.helper != "":
+		return c.askHelper(source, address)
+	}
+	return source.username, source.password, nil
+}
+
+// askHelper runs the credential helper with "get", as git does, passing the
+// host, port and username as key=value lines on stdin and reading the
+// password and optionally the username back the same way
+func (c *credentials) askHelper(source credentialSource, address string) (string, string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "protocol=https\nhost=%s\n", host)
+	if port != "" {
+		fmt.Fprintf(&request, "port=%s\n", port)
+	}
+	if source.username != "" {
+		fmt.Fprintf(&request, "username=%s\n", source.username)
+	}
+	request.WriteString("\n")
+
+	output, err := runHelper(source.helper+" get", request.Bytes())
+	if err != nil {
+		return "", "", fmt.Errorf("error running the credential helper for %s: %s", address, err)
+	}
+
+	username, password, passwordFound := source.username, "", false
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			break
+		}
+		key, value, _ := compat.Cut(line, "=")
+		switch key {
+		case "username":
+			username = value
+		case "password":
+			password, passwordFound = value, true
+		}
+	}
+	if !passwordFound {
+		return "", "", fmt.Errorf("the credential helper did not return a password for %s", address)
+	}
+
+	return username, password, nil
+}
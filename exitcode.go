@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"monitoring-agent-client/internal/compat"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// statePrefixPattern matches output starting with a state followed by " - " or
+// ":", so "Unknown processes: 0" is not taken as the UNKNOWN state
+var statePrefixPattern = regexp.MustCompile(`^(?i)(OK|WARNING|CRITICAL|UNKNOWN)( - |:)`)
+
+// exitCodeMapping turns the remote script's exit code into a Nagios state
+type exitCodeMapping struct {
+	states map[int]int
+	invert bool
+}
+
+func parseExitCodeMapping(mappings []string, invert bool) (exitCodeMapping, error) {
+	mapping := exitCodeMapping{states: map[int]int{}, invert: invert}
+	for _, value := range mappings {
+		code, stateName, found := compat.Cut(value, "=")
+		if !found {
+			return exitCodeMapping{}, fmt.Errorf("invalid exit code mapping %q, expected code=state", value)
+		}
+		exitCode, err := strconv.Atoi(strings.TrimSpace(code))
+		if err != nil {
+			return exitCodeMapping{}, fmt.Errorf("invalid exit code mapping %q, %q is not an exit code", value, code)
+		}
+		state, err := parseState(stateName)
+		if err != nil {
+			return exitCodeMapping{}, fmt.Errorf("invalid exit code mapping %q: %s", value, err)
+		}
+		mapping.states[exitCode] = state
+	}
+	return mapping, nil
+}
+
+// state returns the Nagios state for an exit code. Codes that are not mapped
+// and are not a Nagios state are UNKNOWN, with a note saying so as otherwise
+// the shell truncates them (e.g. -1073741510 would exit as 58). Inverting swaps
+// OK and CRITICAL for "must not be running" style checks.
+func (m exitCodeMapping) state(exitCode int) (int, string) {
+	state, mapped := m.states[exitCode]
+	note := ""
+
+	if !mapped {
+		state = exitCode
+		if exitCode < okExitCode || exitCode > unknownExitCode {
+			state = unknownExitCode
+			note = fmt.Sprintf("the script exited with code %d which is not a Nagios state", exitCode)
+			if exitCode < 0 {
+				note = fmt.Sprintf("the script exited with code %d (0x%08X) which is not a Nagios state", exitCode, uint32(exitCode))
+			}
+		}
+	}
+
+	if m.invert {
+		switch state {
+		case okExitCode:
+			state = criticalExitCode
+		case criticalExitCode:
+			state = okExitCode
+		}
+	}
+
+	return state, note
+}
+
+// prefixState adds "STATE - " to output that does not already start with a
+// state name
+func prefixState(output string, state int) string {
+	if statePrefixPattern.MatchString(output) {
+		return correctStatePrefix(output, state)
+	}
+	return fmt.Sprintf("%s - %s", stateNames[state], output)
+}
+
+// correctStatePrefix replaces the state the script's output starts with when
+// -invert, an exit code mapping or a threshold changed it, so the text does
+// not contradict the state Nagios shows
+func correctStatePrefix(output string, state int) string {
+	match := statePrefixPattern.FindStringSubmatch(output)
+	if match == nil || strings.EqualFold(match[1], stateNames[state]) {
+		return output
+	}
+	return stateNames[state] + output[len(match[1]):]
+}
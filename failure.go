@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"monitoring-agent-client/internal/compat"
+	"net"
+	"strings"
+	"time"
+)
+
+type failureClass string
+
+const (
+	failureDNS               failureClass = "dns"
+	failureConnectionRefused failureClass = "refused"
+	failureConnection        failureClass = "connection"
+	failureTimeout           failureClass = "timeout"
+	failureTLS               failureClass = "tls"
+	failureAuthentication    failureClass = "auth"
+	failureSignature         failureClass = "signature"
+	failureAgentTimeout      failureClass = "agent-timeout"
+	failureServerError       failureClass = "server"
+	failureRequest           failureClass = "request"
+	failureInvalidResponse   failureClass = "response"
+	failureKnownAgent        failureClass = "known-agent"
+)
+
+var failureClasses = []failureClass{
+	failureDNS, failureConnectionRefused, failureConnection, failureTimeout, failureTLS, failureAuthentication,
+	failureSignature, failureAgentTimeout, failureServerError, failureRequest, failureInvalidResponse, failureKnownAgent,
+}
+
+// failure is a problem talking to the agent, as opposed to a result from the
+// script, reported with a message meant for whoever is on call
+type failure struct {
+	class   failureClass
+	message string
+	detail  string
+}
+
+// failureStates maps failure classes to the Nagios state they are reported
+// as, anything not mapped is UNKNOWN
+type failureStates map[failureClass]int
+
+func parseFailureStates(mappings []string) (failureStates, error) {
+	states := failureStates{}
+	for _, mapping := range mappings {
+		name, stateName, found := compat.Cut(mapping, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid error state %q, expected class=state", mapping)
+		}
+		class := failureClass(strings.ToLower(strings.TrimSpace(name)))
+		if !isFailureClass(class) {
+			names := make([]string, len(failureClasses))
+			for index, known := range failureClasses {
+				names[index] = string(known)
+			}
+			return nil, fmt.Errorf("invalid error state %q, the class must be one of: %s", mapping, strings.Join(names, ", "))
+		}
+		state, err := parseState(stateName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error state %q: %s", mapping, err)
+		}
+		states[class] = state
+	}
+	return states, nil
+}
+
+func (s failureStates) stateFor(class failureClass) int {
+	if state, found := s[class]; found {
+		return state
+	}
+	return unknownExitCode
+}
+
+// defaultTo reports the classes without a configured state as state instead
+// of UNKNOWN
+func (s failureStates) defaultTo(state int) {
+	for _, class := range failureClasses {
+		if _, found := s[class]; !found {
+			s[class] = state
+		}
+	}
+}
+
+func isFailureClass(class failureClass) bool {
+	for _, known := range failureClasses {
+		if known == class {
+			return true
+		}
+	}
+	return false
+}
+
+// unreachable is true for the classes where the agent could not be contacted
+// at all, as opposed to it answering with a problem
+func (class failureClass) unreachable() bool {
+	switch class {
+	case failureDNS, failureConnectionRefused, failureConnection, failureTimeout:
+		return true
+	}
+	return false
+}
+
+// classifyTransportError describes an error returned before any response was
+// received, timeouts are classified by the caller which knows the phase
+func classifyTransportError(err error, address string) failure {
+	var dnsError *net.DNSError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	var certificateInvalidError x509.CertificateInvalidError
+	var recordHeaderError tls.RecordHeaderError
+	var pinError pinMismatchError
+	var knownAgentError knownAgentMismatchError
+
+	switch {
+	case errors.As(err, &dnsError):
+		return failure{class: failureDNS, message: fmt.Sprintf("DNS lookup of %s failed: %s", dnsError.Name, dnsError.Err)}
+	case isConnectionRefused(err):
+		return failure{class: failureConnectionRefused, message: fmt.Sprintf("connection to %s refused, check the monitoring agent service is running", address)}
+	case errors.As(err, &unknownAuthorityError):
+		return failure{class: failureTLS, message: fmt.Sprintf("TLS verification of %s failed: %s, check -cacert", address, unknownAuthorityError.Error())}
+	case errors.As(err, &hostnameError):
+		return failure{class: failureTLS, message: fmt.Sprintf("TLS verification of %s failed: %s", address, hostnameError.Error())}
+	case errors.As(err, &certificateInvalidError):
+		return failure{class: failureTLS, message: fmt.Sprintf("TLS verification of %s failed: %s", address, certificateInvalidError.Error())}
+	case errors.As(err, &pinError):
+		return failure{class: failureTLS, message: fmt.Sprintf("TLS verification of %s failed: its %s, check -pin", address, pinError.Error())}
+	case errors.As(err, &knownAgentError):
+		return failure{class: failureKnownAgent, message: knownAgentError.Error() + ", remove the entry with the known-agents subcommand if the change is expected"}
+	case errors.As(err, &recordHeaderError):
+		return failure{class: failureTLS, message: fmt.Sprintf("%s did not respond with TLS, check the port is the monitoring agent's", address)}
+	}
+	return failure{class: failureConnection, message: fmt.Sprintf("error contacting %s: %s", address, err)}
+}
+
+// classifyResponse describes a response from the agent to path that is not a
+// script result, the agent explains itself in the body which is kept as detail
+func classifyResponse(statusCode int, path string, body []byte) failure {
+	lowerCaseBody := strings.ToLower(string(body))
+	detail := responseExcerpt(body)
+
+	switch {
+	case statusCode == 401 || statusCode == 403:
+		return failure{class: failureAuthentication, message: fmt.Sprintf("authentication failed (HTTP %d), check the username and password", statusCode), detail: detail}
+	case statusCode == 400 && strings.Contains(lowerCaseBody, "signature"):
+		return failure{class: failureSignature, message: "the agent rejected the script signature (HTTP 400)", detail: detail}
+	case statusCode == 408 || statusCode == 504 || (statusCode >= 500 && (strings.Contains(lowerCaseBody, "timeout") || strings.Contains(lowerCaseBody, "timed out"))):
+		return failure{class: failureAgentTimeout, message: fmt.Sprintf("the agent timed out running the script (HTTP %d)", statusCode), detail: detail}
+	case statusCode == 404:
+		return failure{class: failureRequest, message: fmt.Sprintf("the agent has no %s endpoint (HTTP 404), check the agent version provides it", path), detail: detail}
+	case statusCode >= 500:
+		return failure{class: failureServerError, message: fmt.Sprintf("the agent failed to handle the request (HTTP %d)", statusCode), detail: detail}
+	}
+	return failure{class: failureRequest, message: fmt.Sprintf("the agent rejected the request (HTTP %d)", statusCode), detail: detail}
+}
+
+func timeoutFailure(kind string, timeout time.Duration, address string, phase requestPhase) failure {
+	return failure{class: failureTimeout, message: fmt.Sprintf("%s timeout after %s contacting %s (phase: %s)", kind, timeout, address, phase)}
+}
+
+// render formats the failure as plugin output in the state configured for
+// its class
+func (problem failure) render(states failureStates) (string, int) {
+	state := states.stateFor(problem.class)
+	output := fmt.Sprintf("%s - %s", stateNames[state], problem.message)
+	if problem.detail != "" {
+		output += "\n" + problem.detail
+	}
+	return output, state
+}
+
+func dieFailure(stdout io.Writer, states failureStates, problem failure) int {
+	output, state := problem.render(states)
+	fmt.Fprint(stdout, output)
+	return state
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// agentAddresses resolves the -host flags and the -hosts-file into host:port
+// addresses, hosts without a port use the -port flag
+func agentAddresses(hosts []string, hostsFilePath string, port int) ([]string, error) {
+	if hostsFilePath != "" {
+		fileHosts, err := readHostsFile(hostsFilePath)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, fileHosts...)
+	}
+
+	var addresses []string
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		// a bare IPv6 address needs brackets around it to add the port
+		address := net.JoinHostPort(strings.Trim(host, "[]"), fmt.Sprint(port))
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			address = host
+		}
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// readHostsFile reads one host per line, blank lines and lines starting with
+// # are skipped
+func readHostsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error loading hosts file: %s", err)
+	}
+	defer file.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading hosts file %s: %s", path, err)
+	}
+	return hosts, nil
+}
+
+// hostChecker is a check that can be run against one agent
+type hostChecker interface {
+	run(address string) hostResult
+}
+
+// fanOut runs the check against every address, at most concurrency at a time,
+// the results are returned in the order of the addresses
+func fanOut(check hostChecker, addresses []string, concurrency int) []hostResult {
+	results := make([]hostResult, len(addresses))
+	slots := make(chan struct{}, concurrency)
+
+	var wait sync.WaitGroup
+	for index, address := range addresses {
+		wait.Add(1)
+		go func(index int, address string) {
+			defer wait.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			results[index] = check.run(address)
+		}(index, address)
+	}
+	wait.Wait()
+
+	return results
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"monitoring-agent-client/internal/nagios"
+	"monitoring-agent-client/internal/pnp4nagios"
 	"os"
-	"time"
+	"strings"
 )
 
 func (i *executableArguments) String() string {
@@ -19,17 +22,65 @@ func (i *executableArguments) Set(value string) error {
 }
 
 type MonitoringAgentResponse struct {
-	Output   string `json:"output"`
-	Exitcode int    `json:"exitcode"`
+	Output   string                     `json:"output"`
+	Exitcode int                        `json:"exitcode"`
+	Extra    map[string]json.RawMessage `json:"-"`
 }
 
 type executableArguments []string
 
+// repeatedArguments collects a flag that may be given multiple times
+type repeatedArguments []string
+
+func (i *repeatedArguments) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *repeatedArguments) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+// stderr receives warnings that must not end up in the plugin output
+var stderr io.Writer = os.Stderr
+
 const okExitCode = 0
 const warningExitCode = 1
 const criticalExitCode = 2
 const unknownExitCode = 3
 
+var stateNames = map[int]string{
+	okExitCode:       "OK",
+	warningExitCode:  "WARNING",
+	criticalExitCode: "CRITICAL",
+	unknownExitCode:  "UNKNOWN",
+}
+
+// stateSeverity orders states for picking the worst, a CRITICAL outranks an
+// UNKNOWN as it is the more certain problem
+var stateSeverity = map[int]int{
+	okExitCode:       0,
+	warningExitCode:  1,
+	unknownExitCode:  2,
+	criticalExitCode: 3,
+}
+
+func worstState(a int, b int) int {
+	if stateSeverity[b] > stateSeverity[a] {
+		return b
+	}
+	return a
+}
+
+func parseState(name string) (int, error) {
+	for state, stateName := range stateNames {
+		if strings.EqualFold(strings.TrimSpace(name), stateName) {
+			return state, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown state %q, expected ok, warning, critical or unknown", name)
+}
+
 func FileExists(name string) bool {
 	_, err := os.Stat(name)
 	if err == nil {
@@ -41,16 +92,42 @@ func FileExists(name string) bool {
 	return false
 }
 
-func enableTimeout(timeout string) time.Duration {
-	timeoutDuration, timeoutParseError := time.ParseDuration(timeout)
-	if timeoutParseError != nil {
-		panic(fmt.Errorf("error parsing timeout value %s", timeoutParseError.Error()))
+// appendLongOutput adds lines after the long output the script returned,
+// keeping them ahead of any perfdata that trails it
+func appendLongOutput(output string, lines []string) string {
+	if len(lines) == 0 {
+		return output
+	}
+	parsed, err := nagios.ParseOutput(output)
+	if err != nil || !strings.Contains(output, "|") {
+		return strings.TrimRight(output, "\r\n") + "\n" + strings.Join(lines, "\n")
+	}
+	parsed.LongOutput = append(parsed.LongOutput, lines...)
+	return parsed.String()
+}
+
+// appendPerfdata merges extra perfdata items with any the script emitted,
+// output with perfdata that cannot be parsed is not rewritten in case that
+// mangles it, a note says the items were left out instead
+func appendPerfdata(output string, perfdata []nagios.Perfdata) string {
+	parsed, err := nagios.ParseOutput(output)
+	if err != nil {
+		return appendLongOutput(output, []string{fmt.Sprintf("the client perfdata was left out as the script's perfdata could not be parsed: %s", err)})
 	}
+	parsed.Perfdata = append(parsed.Perfdata, perfdata...)
+	return parsed.String()
+}
 
-	time.AfterFunc(timeoutDuration, func() {
-		panic(fmt.Sprintf("Client timeout reached: %s\n", timeoutDuration))
-	})
-	return timeoutDuration
+// writeMissingTemplate generates a pnp4nagios template the first time a check
+// returns perfdata, failing to do so must not change the result of the check
+func writeMissingTemplate(directory string, name string, output string) {
+	parsed, err := nagios.ParseOutput(output)
+	if err != nil || len(parsed.Perfdata) == 0 {
+		return
+	}
+	if _, err := pnp4nagios.WriteTemplate(directory, name, parsed.Perfdata, false); err != nil {
+		fmt.Fprintln(stderr, err)
+	}
 }
 
 func die(stdout io.Writer, message string) int {
@@ -0,0 +1,13 @@
+// Package compat has the standard library functions the client needs that
+// are newer than the Go 1.17 go.mod requires
+package compat
+
+import "strings"
+
+// Cut is strings.Cut
+func Cut(s, separator string) (string, string, bool) {
+	if index := strings.Index(s, separator); index >= 0 {
+		return s[:index], s[index+len(separator):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the -config file, YAML or JSON (which YAML is a superset of)
+type Config struct {
+	MinisignPublicKey string              `yaml:"minisignPublicKey"`
+	KnownAgents       string              `yaml:"knownAgents"`
+	ErrorStates       map[string]string   `yaml:"errorStates"`
+	Agents            map[string]Agent    `yaml:"agents"`
+	Checks            map[string]Check    `yaml:"checks"`
+	Groups            map[string][]string `yaml:"groups"`
+}
+
+type Agent struct {
+	Host                 string     `yaml:"host"`
+	Port                 int        `yaml:"port"`
+	CACert               StringList `yaml:"cacert"`
+	CADirectory          string     `yaml:"cadir"`
+	CASystem             bool       `yaml:"caSystem"`
+	Certificate          string     `yaml:"certificate"`
+	Key                  string     `yaml:"key"`
+	KeyPassphraseFile    string     `yaml:"keyPassphraseFile"`
+	KeyPassphraseCommand string     `yaml:"keyPassphraseCommand"`
+	Insecure             bool       `yaml:"insecure"`
+	Pins                 []string   `yaml:"pins"`
+	Tofu                 bool       `yaml:"tofu"`
+	ServerName           string     `yaml:"serverName"`
+	TLSMinVersion        string     `yaml:"tlsMinVersion"`
+	TLSMaxVersion        string     `yaml:"tlsMaxVersion"`
+	TLSCiphers           []string   `yaml:"tlsCiphers"`
+	TLSCurves            []string   `yaml:"tlsCurves"`
+	Username             string     `yaml:"username"`
+	Password             string     `yaml:"password"`
+	PasswordEnv          string     `yaml:"passwordEnv"`
+	PasswordFile         string     `yaml:"passwordFile"`
+	CredentialHelper     string     `yaml:"credentialHelper"`
+}
+
+type Check struct {
+	Probe            bool              `yaml:"probe"`
+	CheckCerts       bool              `yaml:"checkCerts"`
+	CertWarning      *int              `yaml:"certWarning"`
+	CertCritical     *int              `yaml:"certCritical"`
+	Mode             string            `yaml:"mode"`
+	Script           string            `yaml:"script"`
+	Interpreter      string            `yaml:"interpreter"`
+	Executable       string            `yaml:"executable"`
+	ExecutableArgs   []string          `yaml:"executableArgs"`
+	ScriptArgs       []string          `yaml:"scriptArgs"`
+	Timeout          string            `yaml:"timeout"`
+	ExitCodeMap      map[string]string `yaml:"exitCodeMap"`
+	Invert           bool              `yaml:"invert"`
+	PrefixState      bool              `yaml:"prefixState"`
+	Warning          map[string]string `yaml:"warning"`
+	Critical         map[string]string `yaml:"critical"`
+	Aggregate        string            `yaml:"aggregate"`
+	UnreachableState string            `yaml:"unreachableState"`
+}
+
+// StringList is a list that may also be written as a single value
+type StringList []string
+
+func (list *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*list = StringList{value.Value}
+		return nil
+	}
+	var values []string
+	if err := value.Decode(&values); err != nil {
+		return err
+	}
+	*list = values
+	return nil
+}
+
+func Load(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error loading config file: %s", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	loaded := new(Config)
+	if err := decoder.Decode(loaded); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %s", path, err)
+	}
+	return loaded, nil
+}
+
+// Agent returns the named agent profile, the profile name is used as the host
+// when it does not set one
+func (c *Config) Agent(name string) (Agent, error) {
+	agent, found := c.Agents[name]
+	if !found {
+		return Agent{}, fmt.Errorf("agent %q is not defined in the config file", name)
+	}
+	if agent.Host == "" {
+		agent.Host = name
+	}
+	return agent, nil
+}
+
+func (c *Config) Check(name string) (Check, error) {
+	check, found := c.Checks[name]
+	if !found {
+		return Check{}, fmt.Errorf("check %q is not defined in the config file", name)
+	}
+	return check, nil
+}
+
+// Group returns the hosts of the named group, each may include a :port
+func (c *Config) Group(name string) ([]string, error) {
+	hosts, found := c.Groups[name]
+	if !found {
+		return nil, fmt.Errorf("group %q is not defined in the config file", name)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("group %q has no hosts", name)
+	}
+	return hosts, nil
+}
@@ -2,7 +2,6 @@ package httpclient
 
 import (
 	"net/http"
-	"time"
 )
 
 type concrete struct {
@@ -17,11 +16,6 @@ func (H concrete) Do(r *http.Request) (*http.Response, error) {
 	return H.wrappedClient.Do(r)
 }
 
-func (H concrete) SetTimeout(timeout time.Duration) {
-	H.wrappedClient.Timeout = timeout
-	//fmt.Printf("SETTING TIMEOUT%#v", timeout)
-}
-
 func (H concrete) SetTransport(transport *http.Transport) {
 	H.wrappedClient.Transport = transport
 	//fmt.Printf("SETTING TRANSPORT%#v", transport)
@@ -10,7 +10,7 @@ import (
 )
 
 type mock struct {
-	Timeout            time.Duration
+	Deadline           time.Time
 	Transport          *http.Transport
 	RequestBodyContent string
 	RequestVerb        string
@@ -19,7 +19,6 @@ type mock struct {
 	RequestHost        string
 
 	DoFunc         func(*http.Request) (*http.Response, error)
-	DoSetTimeout   func(time.Duration)
 	DoSetTransport func(*http.Transport)
 }
 
@@ -27,10 +26,6 @@ func (H mock) Do(r *http.Request) (*http.Response, error) {
 	return H.DoFunc(r)
 }
 
-func (H mock) SetTimeout(timeout time.Duration) {
-	H.DoSetTimeout(timeout)
-}
-
 func (H mock) SetTransport(transport *http.Transport) {
 	H.DoSetTransport(transport)
 }
@@ -45,6 +40,7 @@ func NewMockHTTPClient(jsonResponse string, httpResponseCode int) *mock {
 		client.RequestURI = r.URL
 		client.RequestHost = r.Host
 		client.RequestHeaders = r.Header
+		client.Deadline, _ = r.Context().Deadline()
 
 		return &http.Response{
 			Body:       io.NopCloser(strings.NewReader(jsonResponse)),
@@ -52,9 +48,6 @@ func NewMockHTTPClient(jsonResponse string, httpResponseCode int) *mock {
 		}, nil
 	}
 
-	client.DoSetTimeout = func(timeout time.Duration) {
-		client.Timeout = timeout
-	}
 	client.DoSetTransport = func(transport *http.Transport) {
 		client.Transport = transport
 	}
@@ -0,0 +1,126 @@
+// Package identity loads the client certificate and key presented to agents,
+// from PEM files with an optionally encrypted key or from a PKCS#12 bundle
+package identity
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Passphrase is asked for the passphrase only when the key or bundle turns
+// out to be encrypted
+type Passphrase func() ([]byte, error)
+
+// IsPKCS12 is true for the .p12 and .pfx bundles Windows exports
+func IsPKCS12(path string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
+	return extension == ".p12" || extension == ".pfx"
+}
+
+// LoadKeyPair reads a PEM certificate and private key, decrypting the key if
+// it is an encrypted PKCS#8 or legacy OpenSSL encrypted PEM block
+func LoadKeyPair(certificatePath string, keyPath string, passphrase Passphrase) (tls.Certificate, error) {
+	certificatePEM, err := ioutil.ReadFile(certificatePath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || !isEncrypted(block) {
+		return tls.X509KeyPair(certificatePEM, keyPEM)
+	}
+
+	password, err := passphrase()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	privateKey, err := decryptPEMBlock(block, password)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error decrypting %s: %s", keyPath, err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certificatePEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// LoadPKCS12 reads a certificate, its chain and private key from a PKCS#12
+// bundle, one without a password is read without asking for the passphrase
+func LoadPKCS12(path string, passphrase Passphrase) (tls.Certificate, error) {
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	privateKey, certificate, chain, err := pkcs12.DecodeChain(bundle, "")
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+		var password []byte
+		password, err = passphrase()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		privateKey, certificate, chain, err = pkcs12.DecodeChain(bundle, string(password))
+	}
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+		return tls.Certificate{}, fmt.Errorf("error decrypting %s: %s", path, ErrIncorrectPassphrase)
+	}
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	identity := tls.Certificate{
+		Certificate: [][]byte{certificate.Raw},
+		PrivateKey:  privateKey,
+		Leaf:        certificate,
+	}
+	for _, issuer := range chain {
+		identity.Certificate = append(identity.Certificate, issuer.Raw)
+	}
+	return identity, nil
+}
+
+func isEncrypted(block *pem.Block) bool {
+	//lint:ignore SA1019 legacy encrypted PEM keys are still written by openssl genrsa -aes256
+	return block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block)
+}
+
+func decryptPEMBlock(block *pem.Block, passphrase []byte) (interface{}, error) {
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return DecryptPKCS8(block.Bytes, passphrase)
+	}
+
+	//lint:ignore SA1019 legacy encrypted PEM keys are still written by openssl genrsa -aes256
+	der, err := x509.DecryptPEMBlock(block, passphrase)
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		return nil, ErrIncorrectPassphrase
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+	return privateKey, nil
+}
@@ -0,0 +1,160 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// ErrIncorrectPassphrase is returned when a key or bundle cannot be decrypted
+// with the passphrase given
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+
+// encryptedPrivateKeyInfo is the "ENCRYPTED PRIVATE KEY" PEM block, RFC 5958
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Parameters struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Parameters struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// DecryptPKCS8 decrypts an encrypted PKCS#8 private key, as written by
+// `openssl pkcs8 -topk8` or `openssl genpkey -aes256`. Only PBES2 with PBKDF2
+// is supported, which is what everything has written by default for years.
+func DecryptPKCS8(der []byte, passphrase []byte) (interface{}, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("invalid encrypted private key: %s", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+
+	var parameters pbes2Parameters
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &parameters); err != nil {
+		return nil, fmt.Errorf("invalid PBES2 parameters: %s", err)
+	}
+	if !parameters.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %s, only PBKDF2 is supported", parameters.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Parameters
+	if _, err := asn1.Unmarshal(parameters.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("invalid PBKDF2 parameters: %s", err)
+	}
+	prf, err := pbkdf2PRF(kdf.PRF.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	newCipher, keyLength, err := pbes2Cipher(parameters.EncryptionScheme.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(parameters.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("invalid encryption parameters: %s", err)
+	}
+
+	key := pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keyLength, prf)
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("invalid encrypted private key length")
+	}
+
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+
+	plaintext, err = unpad(plaintext, block.BlockSize())
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(plaintext)
+	if err != nil {
+		// the padding matches by chance for about one wrong passphrase in 256
+		return nil, ErrIncorrectPassphrase
+	}
+	return privateKey, nil
+}
+
+func pbkdf2PRF(algorithm asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case len(algorithm) == 0, algorithm.Equal(oidHMACWithSHA1):
+		return sha1.New, nil
+	case algorithm.Equal(oidHMACWithSHA256):
+		return sha256.New, nil
+	case algorithm.Equal(oidHMACWithSHA384):
+		return sha512.New384, nil
+	case algorithm.Equal(oidHMACWithSHA512):
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported PBKDF2 hash %s", algorithm)
+}
+
+func pbes2Cipher(algorithm asn1.ObjectIdentifier) (func([]byte) (cipher.Block, error), int, error) {
+	switch {
+	case algorithm.Equal(oidAES128CBC):
+		return aes.NewCipher, 16, nil
+	case algorithm.Equal(oidAES192CBC):
+		return aes.NewCipher, 24, nil
+	case algorithm.Equal(oidAES256CBC):
+		return aes.NewCipher, 32, nil
+	case algorithm.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported private key cipher %s", algorithm)
+}
+
+// unpad removes the PKCS#7 padding, which only comes out right with the
+// correct passphrase
+func unpad(plaintext []byte, blockSize int) ([]byte, error) {
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > blockSize {
+		return nil, ErrIncorrectPassphrase
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, ErrIncorrectPassphrase
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
@@ -0,0 +1,159 @@
+// Package minisign reads and writes the key and signature formats used by
+// minisign (https://jedisct1.github.io/minisign/), which the monitoring agent
+// uses to verify scripts sent to it
+package minisign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const untrustedCommentPrefix = "untrusted comment: "
+const trustedCommentPrefix = "trusted comment: "
+
+var legacyAlgorithm = [2]byte{'E', 'd'}
+var prehashedAlgorithm = [2]byte{'E', 'D'}
+
+type PublicKey struct {
+	KeyID [8]byte
+	Key   ed25519.PublicKey
+}
+
+type Signature struct {
+	UntrustedComment string
+	Algorithm        [2]byte
+	KeyID            [8]byte
+	Signature        [ed25519.SignatureSize]byte
+	TrustedComment   string
+	GlobalSignature  [ed25519.SignatureSize]byte
+}
+
+// ParsePublicKey accepts either the bare base64 key, as passed to `minisign -P`,
+// or the content of a minisign.pub file
+func ParsePublicKey(content string) (PublicKey, error) {
+	lines := nonEmptyLines(content)
+	if len(lines) == 0 {
+		return PublicKey{}, errors.New("invalid minisign public key: it is empty")
+	}
+	encoded := lines[len(lines)-1]
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) != 2+8+ed25519.PublicKeySize {
+		return PublicKey{}, errors.New("invalid minisign public key: expected base64 encoded algorithm, key id and key")
+	}
+	if !bytes.Equal(decoded[:2], legacyAlgorithm[:]) {
+		return PublicKey{}, fmt.Errorf("invalid minisign public key: unsupported algorithm %q", decoded[:2])
+	}
+
+	var publicKey PublicKey
+	copy(publicKey.KeyID[:], decoded[2:10])
+	publicKey.Key = ed25519.PublicKey(decoded[10:])
+	return publicKey, nil
+}
+
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(append(append(legacyAlgorithm[:], k.KeyID[:]...), k.Key...))
+}
+
+func ParseSignature(content string) (Signature, error) {
+	lines := nonEmptyLines(content)
+	if len(lines) != 4 {
+		return Signature{}, fmt.Errorf("invalid minisign signature: expected 4 lines, found %d", len(lines))
+	}
+	if !strings.HasPrefix(lines[0], untrustedCommentPrefix) {
+		return Signature{}, errors.New("invalid minisign signature: the first line is not an untrusted comment")
+	}
+	if !strings.HasPrefix(lines[2], trustedCommentPrefix) {
+		return Signature{}, errors.New("invalid minisign signature: the third line is not a trusted comment")
+	}
+
+	var signature Signature
+	signature.UntrustedComment = strings.TrimPrefix(lines[0], untrustedCommentPrefix)
+	signature.TrustedComment = strings.TrimPrefix(lines[2], trustedCommentPrefix)
+
+	decoded, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(decoded) != 2+8+ed25519.SignatureSize {
+		return Signature{}, errors.New("invalid minisign signature: expected base64 encoded algorithm, key id and signature")
+	}
+	copy(signature.Algorithm[:], decoded[:2])
+	copy(signature.KeyID[:], decoded[2:10])
+	copy(signature.Signature[:], decoded[10:])
+	if signature.Algorithm != legacyAlgorithm && signature.Algorithm != prehashedAlgorithm {
+		return Signature{}, fmt.Errorf("invalid minisign signature: unsupported algorithm %q", signature.Algorithm[:])
+	}
+
+	globalSignature, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSignature) != ed25519.SignatureSize {
+		return Signature{}, errors.New("invalid minisign signature: expected a base64 encoded global signature")
+	}
+	copy(signature.GlobalSignature[:], globalSignature)
+
+	return signature, nil
+}
+
+// String renders the signature as a .minisig file
+func (s Signature) String() string {
+	encodedSignature := base64.StdEncoding.EncodeToString(append(append(s.Algorithm[:], s.KeyID[:]...), s.Signature[:]...))
+	encodedGlobalSignature := base64.StdEncoding.EncodeToString(s.GlobalSignature[:])
+	return untrustedCommentPrefix + s.UntrustedComment + "\n" +
+		encodedSignature + "\n" +
+		trustedCommentPrefix + s.TrustedComment + "\n" +
+		encodedGlobalSignature + "\n"
+}
+
+// TrustedFilename returns the file: field of the trusted comment, which
+// minisign sets to the name of the file that was signed
+func (s Signature) TrustedFilename() string {
+	for _, field := range strings.Split(s.TrustedComment, "\t") {
+		if strings.HasPrefix(field, "file:") {
+			return strings.TrimPrefix(field, "file:")
+		}
+	}
+	return ""
+}
+
+// Verify checks both the signature of the message and the global signature
+// covering the trusted comment
+func (k PublicKey) Verify(message []byte, signature Signature) error {
+	if signature.KeyID != k.KeyID {
+		return fmt.Errorf("the signature was made with key %s, not %s", FormatKeyID(signature.KeyID), FormatKeyID(k.KeyID))
+	}
+
+	if signature.Algorithm == prehashedAlgorithm {
+		hash := blake2b.Sum512(message)
+		message = hash[:]
+	}
+	if !ed25519.Verify(k.Key, message, signature.Signature[:]) {
+		return errors.New("the signature does not match the content")
+	}
+
+	if !ed25519.Verify(k.Key, append(signature.Signature[:], []byte(signature.TrustedComment)...), signature.GlobalSignature[:]) {
+		return errors.New("the trusted comment signature does not match")
+	}
+
+	return nil
+}
+
+// FormatKeyID renders a key id the way minisign displays it, as a little
+// endian 64 bit number
+func FormatKeyID(keyID [8]byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(keyID[:]))
+}
+
+func nonEmptyLines(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,123 @@
+package minisign
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignature(t *testing.T) {
+	t.Run("Signatures with windows line endings are parsed", func(t *testing.T) {
+		content, _ := ioutil.ReadFile("../../TestScript.pl.minisig")
+
+		signature, err := ParseSignature(string(content))
+
+		assert.Nil(t, err)
+		assert.Equal(t, legacyAlgorithm, signature.Algorithm)
+		assert.Equal(t, "signature from minisign secret key", signature.UntrustedComment)
+		assert.Equal(t, "timestamp:1634631414\tfile:TestScript.pl", signature.TrustedComment)
+		assert.Equal(t, "TestScript.pl", signature.TrustedFilename())
+		assert.Equal(t, strings.ReplaceAll(string(content), "\r\n", "\n"), signature.String())
+	})
+
+	t.Run("Signatures are verified against the content and trusted comment", func(t *testing.T) {
+		publicKeyContent, _ := ioutil.ReadFile("../../TestScript-Signed.pub")
+		signatureContent, _ := ioutil.ReadFile("../../TestScript-Signed.pl.minisig")
+		script, _ := ioutil.ReadFile("../../TestScript-Signed.pl")
+
+		publicKey, err := ParsePublicKey(string(publicKeyContent))
+		assert.Nil(t, err)
+		assert.Equal(t, "60B1425DCF6FA06D", FormatKeyID(publicKey.KeyID))
+
+		signature, err := ParseSignature(string(signatureContent))
+		assert.Nil(t, err)
+		assert.Nil(t, publicKey.Verify(script, signature))
+
+		assert.EqualError(t, publicKey.Verify(append(script, '\n'), signature), "the signature does not match the content")
+
+		signature.TrustedComment = "timestamp:1792310400\tfile:Other.pl"
+		assert.EqualError(t, publicKey.Verify(script, signature), "the trusted comment signature does not match")
+	})
+
+	t.Run("Malformed signatures are rejected", func(t *testing.T) {
+		_, err := ParseSignature("untrusted comment: x\nnotbase64\ntrusted comment: y\nnotbase64\n")
+		assert.EqualError(t, err, "invalid minisign signature: expected base64 encoded algorithm, key id and signature")
+
+		_, err = ParseSignature("untrusted comment: x\n")
+		assert.EqualError(t, err, "invalid minisign signature: expected 4 lines, found 1")
+	})
+}
+
+func TestSecretKey(t *testing.T) {
+	oldOpsLimit, oldMemLimit := kdfOpsLimit, kdfMemLimit
+	defer func() { kdfOpsLimit, kdfMemLimit = oldOpsLimit, oldMemLimit }()
+	kdfOpsLimit, kdfMemLimit = 32768, 16777216
+
+	t.Run("An encrypted secret key and signatures from another minisign implementation are read and reproduced", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip("decrypting the key takes minisign's 1GiB of scrypt memory")
+		}
+		secretKeyContent, _ := ioutil.ReadFile("testdata/minisign.key")
+		publicKeyContent, _ := ioutil.ReadFile("testdata/minisign.pub")
+		message, _ := ioutil.ReadFile("testdata/message.txt")
+
+		secretKey, err := ParseSecretKey(string(secretKeyContent), []byte("correct horse battery staple"))
+		assert.Nil(t, err)
+		publicKey, err := ParsePublicKey(string(publicKeyContent))
+		assert.Nil(t, err)
+		assert.Equal(t, publicKey, secretKey.PublicKey())
+
+		for _, testCase := range []struct {
+			file    string
+			prehash bool
+		}{
+			{"testdata/message.txt.minisig", false},
+			{"testdata/message.txt.prehashed.minisig", true},
+		} {
+			signatureContent, _ := ioutil.ReadFile(testCase.file)
+			signature, err := ParseSignature(string(signatureContent))
+			assert.Nil(t, err)
+			assert.Nil(t, publicKey.Verify(message, signature), testCase.file)
+
+			signed := secretKey.Sign(message, signature.TrustedComment, testCase.prehash)
+			assert.Equal(t, string(signatureContent), signed.String(), testCase.file)
+		}
+	})
+
+	t.Run("Encrypted secret keys round trip and sign verifiable signatures", func(t *testing.T) {
+		publicKey, secretKey, err := GenerateKey(rand.Reader)
+		assert.Nil(t, err)
+
+		encoded, err := secretKey.Encode(rand.Reader, []byte("correct horse"))
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(encoded, "untrusted comment: minisign encrypted secret key\n"))
+
+		_, err = ParseSecretKey(encoded, []byte("battery staple"))
+		assert.EqualError(t, err, "wrong password for the minisign secret key")
+
+		decoded, err := ParseSecretKey(encoded, []byte("correct horse"))
+		assert.Nil(t, err)
+		assert.Equal(t, secretKey, decoded)
+
+		for _, prehash := range []bool{false, true} {
+			signature := decoded.Sign([]byte("script"), "timestamp:1792310400\tfile:script.pl", prehash)
+			parsed, err := ParseSignature(signature.String())
+			assert.Nil(t, err)
+			assert.Nil(t, publicKey.Verify([]byte("script"), parsed))
+		}
+	})
+
+	t.Run("Unencrypted secret keys need no password", func(t *testing.T) {
+		_, secretKey, _ := GenerateKey(rand.Reader)
+
+		encoded, err := secretKey.Encode(rand.Reader, nil)
+		assert.Nil(t, err)
+
+		decoded, err := ParseSecretKey(encoded, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, secretKey, decoded)
+	})
+}
@@ -0,0 +1,210 @@
+package minisign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/scrypt"
+)
+
+var scryptAlgorithm = [2]byte{'S', 'c'}
+var noKDFAlgorithm = [2]byte{0, 0}
+var blake2bAlgorithm = [2]byte{'B', '2'}
+
+// the limits minisign uses, libsodium's "sensitive" scrypt parameters
+var kdfOpsLimit uint64 = 33554432
+var kdfMemLimit uint64 = 1073741824
+
+const secretKeyLength = 2 + 2 + 2 + 32 + 8 + 8 + 8 + ed25519.PrivateKeySize + 32
+
+// ErrPasswordRequired is returned when an encrypted secret key is parsed
+// without a password
+var ErrPasswordRequired = errors.New("the minisign secret key is encrypted, a password is required")
+
+type SecretKey struct {
+	KeyID [8]byte
+	Key   ed25519.PrivateKey
+}
+
+func GenerateKey(random io.Reader) (PublicKey, SecretKey, error) {
+	var secretKey SecretKey
+	if _, err := io.ReadFull(random, secretKey.KeyID[:]); err != nil {
+		return PublicKey{}, SecretKey{}, err
+	}
+	_, privateKey, err := ed25519.GenerateKey(random)
+	if err != nil {
+		return PublicKey{}, SecretKey{}, err
+	}
+	secretKey.Key = privateKey
+	return secretKey.PublicKey(), secretKey, nil
+}
+
+func (k SecretKey) PublicKey() PublicKey {
+	return PublicKey{KeyID: k.KeyID, Key: k.Key.Public().(ed25519.PublicKey)}
+}
+
+// ParseSecretKey reads a minisign secret key file, the password is only used
+// when the key is encrypted
+func ParseSecretKey(content string, password []byte) (SecretKey, error) {
+	lines := nonEmptyLines(content)
+	if len(lines) == 0 {
+		return SecretKey{}, errors.New("invalid minisign secret key: it is empty")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(lines[len(lines)-1])
+	if err != nil || len(decoded) != secretKeyLength {
+		return SecretKey{}, errors.New("invalid minisign secret key: unexpected encoding or length")
+	}
+
+	signatureAlgorithm, kdfAlgorithm, checksumAlgorithm := decoded[0:2], decoded[2:4], decoded[4:6]
+	salt := decoded[6:38]
+	opsLimit := binary.LittleEndian.Uint64(decoded[38:46])
+	memLimit := binary.LittleEndian.Uint64(decoded[46:54])
+	keyMaterial := append([]byte(nil), decoded[54:]...)
+
+	if !bytes.Equal(signatureAlgorithm, legacyAlgorithm[:]) || !bytes.Equal(checksumAlgorithm, blake2bAlgorithm[:]) {
+		return SecretKey{}, errors.New("invalid minisign secret key: unsupported algorithm")
+	}
+
+	switch {
+	case bytes.Equal(kdfAlgorithm, scryptAlgorithm[:]):
+		if len(password) == 0 {
+			return SecretKey{}, ErrPasswordRequired
+		}
+		stream, err := kdfStream(password, salt, opsLimit, memLimit)
+		if err != nil {
+			return SecretKey{}, err
+		}
+		xorBytes(keyMaterial, stream)
+	case bytes.Equal(kdfAlgorithm, noKDFAlgorithm[:]):
+	default:
+		return SecretKey{}, errors.New("invalid minisign secret key: unsupported key derivation algorithm")
+	}
+
+	var secretKey SecretKey
+	copy(secretKey.KeyID[:], keyMaterial[:8])
+	secretKey.Key = ed25519.PrivateKey(keyMaterial[8 : 8+ed25519.PrivateKeySize])
+
+	if subtle.ConstantTimeCompare(secretKey.checksum(), keyMaterial[8+ed25519.PrivateKeySize:]) != 1 {
+		return SecretKey{}, errors.New("wrong password for the minisign secret key")
+	}
+
+	return secretKey, nil
+}
+
+// Encode renders the key as a minisign secret key file, encrypted with the
+// password unless it is empty
+func (k SecretKey) Encode(random io.Reader, password []byte) (string, error) {
+	encoded := make([]byte, 0, secretKeyLength)
+	encoded = append(encoded, legacyAlgorithm[:]...)
+
+	keyMaterial := append(append(append([]byte(nil), k.KeyID[:]...), k.Key...), k.checksum()...)
+	salt := make([]byte, 32)
+	opsLimit, memLimit := uint64(0), uint64(0)
+	comment := "minisign secret key"
+
+	if len(password) > 0 {
+		if _, err := io.ReadFull(random, salt); err != nil {
+			return "", err
+		}
+		opsLimit, memLimit = kdfOpsLimit, kdfMemLimit
+		stream, err := kdfStream(password, salt, opsLimit, memLimit)
+		if err != nil {
+			return "", err
+		}
+		xorBytes(keyMaterial, stream)
+		encoded = append(encoded, scryptAlgorithm[:]...)
+		comment = "minisign encrypted secret key"
+	} else {
+		encoded = append(encoded, noKDFAlgorithm[:]...)
+	}
+
+	encoded = append(encoded, blake2bAlgorithm[:]...)
+	encoded = append(encoded, salt...)
+	limits := make([]byte, 16)
+	binary.LittleEndian.PutUint64(limits[:8], opsLimit)
+	binary.LittleEndian.PutUint64(limits[8:], memLimit)
+	encoded = append(encoded, limits...)
+	encoded = append(encoded, keyMaterial...)
+
+	return untrustedCommentPrefix + comment + "\n" + base64.StdEncoding.EncodeToString(encoded) + "\n", nil
+}
+
+// Sign produces a signature in the legacy format the agent verifies, or the
+// blake2b prehashed format newer minisign versions default to
+func (k SecretKey) Sign(message []byte, trustedComment string, prehash bool) Signature {
+	signature := Signature{
+		UntrustedComment: "signature from minisign secret key",
+		Algorithm:        legacyAlgorithm,
+		KeyID:            k.KeyID,
+		TrustedComment:   trustedComment,
+	}
+	if prehash {
+		signature.Algorithm = prehashedAlgorithm
+		hash := blake2b.Sum512(message)
+		message = hash[:]
+	}
+
+	copy(signature.Signature[:], ed25519.Sign(k.Key, message))
+	copy(signature.GlobalSignature[:], ed25519.Sign(k.Key, append(signature.Signature[:], []byte(trustedComment)...)))
+
+	return signature
+}
+
+func (k SecretKey) checksum() []byte {
+	checksum := blake2b.Sum256(append(append(append([]byte(nil), legacyAlgorithm[:]...), k.KeyID[:]...), k.Key...))
+	return checksum[:]
+}
+
+// kdfStream derives the key stream the same way libsodium's
+// crypto_pwhash_scryptsalsa208sha256 picks scrypt parameters from its limits
+func kdfStream(password []byte, salt []byte, opsLimit uint64, memLimit uint64) ([]byte, error) {
+	if opsLimit < 32768 {
+		opsLimit = 32768
+	}
+
+	r := uint64(8)
+	p := uint64(1)
+	var maxN uint64
+	if opsLimit < memLimit/32 {
+		maxN = opsLimit / (r * 4)
+	} else {
+		maxN = memLimit / (r * 128)
+	}
+
+	nLog2 := uint(1)
+	for ; nLog2 < 63; nLog2++ {
+		if uint64(1)<<nLog2 > maxN/2 {
+			break
+		}
+	}
+
+	if opsLimit >= memLimit/32 {
+		maxRP := (opsLimit / 4) / (uint64(1) << nLog2)
+		if maxRP > 0x3fffffff {
+			maxRP = 0x3fffffff
+		}
+		p = maxRP / r
+		if p == 0 {
+			p = 1
+		}
+	}
+
+	stream, err := scrypt.Key(password, salt, 1<<nLog2, int(r), int(p), 8+ed25519.PrivateKeySize+32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving the minisign secret key encryption key: %s", err)
+	}
+	return stream, nil
+}
+
+func xorBytes(destination []byte, stream []byte) {
+	for index := range destination {
+		destination[index] ^= stream[index]
+	}
+}
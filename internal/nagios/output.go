@@ -0,0 +1,78 @@
+package nagios
+
+import (
+	"monitoring-agent-client/internal/compat"
+	"strings"
+)
+
+// Output is plugin output split the way Nagios reads it:
+//
+//	TEXT | PERFDATA
+//	LONG OUTPUT
+//	LONG OUTPUT | PERFDATA
+//	PERFDATA
+//
+// perfdata on the first line and everything after the first '|' in the long
+// output are both collected into Perfdata
+type Output struct {
+	Text       string
+	LongOutput []string
+	Perfdata   []Perfdata
+}
+
+// ParseOutput splits raw plugin output, invalid perfdata items are left out
+// of the result and reported together in the returned error
+func ParseOutput(raw string) (Output, error) {
+	lines := strings.Split(strings.TrimRight(raw, "\r\n"), "\n")
+	for index := range lines {
+		lines[index] = strings.TrimSuffix(lines[index], "\r")
+	}
+
+	var parsed Output
+	var perfdataSections []string
+
+	text, perfdata, found := compat.Cut(lines[0], "|")
+	parsed.Text = strings.TrimSpace(text)
+	if found {
+		perfdataSections = append(perfdataSections, perfdata)
+	}
+
+	for index, line := range lines[1:] {
+		longOutput, perfdata, found := compat.Cut(line, "|")
+		if !found {
+			parsed.LongOutput = append(parsed.LongOutput, line)
+			continue
+		}
+		if strings.TrimSpace(longOutput) != "" {
+			parsed.LongOutput = append(parsed.LongOutput, strings.TrimRight(longOutput, " "))
+		}
+		perfdataSections = append(perfdataSections, perfdata)
+		perfdataSections = append(perfdataSections, lines[index+2:]...)
+		break
+	}
+
+	perfdataItems, err := ParsePerfdataList(strings.Join(perfdataSections, " "))
+	parsed.Perfdata = perfdataItems
+
+	return parsed, err
+}
+
+func (o Output) String() string {
+	var rendered strings.Builder
+
+	rendered.WriteString(o.Text)
+	if len(o.Perfdata) > 0 {
+		items := make([]string, len(o.Perfdata))
+		for index, perfdata := range o.Perfdata {
+			items[index] = perfdata.String()
+		}
+		rendered.WriteString(" | ")
+		rendered.WriteString(strings.Join(items, " "))
+	}
+	for _, line := range o.LongOutput {
+		rendered.WriteString("\n")
+		rendered.WriteString(line)
+	}
+
+	return rendered.String()
+}
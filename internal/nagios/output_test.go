@@ -0,0 +1,125 @@
+package nagios
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOutput(t *testing.T) {
+	t.Run("Output without perfdata is kept as the status text", func(t *testing.T) {
+		parsed, err := ParseOutput("OK - all good\n")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "OK - all good", parsed.Text)
+		assert.Nil(t, parsed.LongOutput)
+		assert.Nil(t, parsed.Perfdata)
+	})
+
+	t.Run("Perfdata on the first line, in the long output and on trailing lines is collected", func(t *testing.T) {
+		parsed, err := ParseOutput("DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968\r\n/ 15272 MB (77%);\r\n/boot 68 MB (69%);\r\n/home 69357 MB (27%); | /boot=68MB;88;93;0;98\r\n/home=69357MB;253404;253409;0;253414 \r\n'/var log'=818MB;970;975;0;980\r\n")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "DISK OK - free space: / 3326 MB (56%);", parsed.Text)
+		assert.Equal(t, []string{"/ 15272 MB (77%);", "/boot 68 MB (69%);", "/home 69357 MB (27%);"}, parsed.LongOutput)
+		assert.Equal(t, 4, len(parsed.Perfdata))
+		assert.Equal(t, Perfdata{Label: "/", Value: "2643", UOM: "MB", Warning: "5948", Critical: "5958", Min: "0", Max: "5968"}, parsed.Perfdata[0])
+		assert.Equal(t, "/home", parsed.Perfdata[2].Label)
+		assert.Equal(t, "/var log", parsed.Perfdata[3].Label)
+	})
+
+	t.Run("Invalid perfdata items are reported but valid items are kept", func(t *testing.T) {
+		parsed, err := ParseOutput("OK | time=0.1s broken size=12,5KB count=3c;5;10")
+
+		assert.EqualError(t, err, `invalid perfdata "broken": expected label=value; invalid perfdata "size=12,5KB": value "12,5KB" is not a number with an optional unit`)
+		assert.Equal(t, 2, len(parsed.Perfdata))
+		assert.Equal(t, "time", parsed.Perfdata[0].Label)
+		assert.Equal(t, "count", parsed.Perfdata[1].Label)
+	})
+
+	t.Run("Rendering puts all perfdata on the first line", func(t *testing.T) {
+		parsed, _ := ParseOutput("WARNING - slow\nfirst detail | a=1;;;;\nb=2s;1:;@3:4")
+
+		assert.Equal(t, "WARNING - slow | a=1 b=2s;1:;@3:4\nfirst detail", parsed.String())
+	})
+}
+
+func TestParsePerfdata(t *testing.T) {
+	t.Run("Quoted labels may contain spaces and escaped quotes", func(t *testing.T) {
+		parsed, err := ParsePerfdata("'it''s a label'=5%;80;90")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "it's a label", parsed.Label)
+		assert.Equal(t, "5", parsed.Value)
+		assert.Equal(t, "%", parsed.UOM)
+		assert.Equal(t, "'it''s a label'=5%;80;90", parsed.String())
+	})
+
+	t.Run("Unknown values are accepted", func(t *testing.T) {
+		parsed, err := ParsePerfdata("load=U")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "U", parsed.Value)
+		_, err = parsed.Number()
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Invalid thresholds and limits are rejected", func(t *testing.T) {
+		_, err := ParsePerfdata("a=1;10:5")
+		assert.EqualError(t, err, `invalid perfdata "a=1;10:5": invalid range "10:5": start is greater than end`)
+
+		_, err = ParsePerfdata("a=1;;;zero")
+		assert.EqualError(t, err, `invalid perfdata "a=1;;;zero": min/max "zero" is not a number`)
+
+		_, err = ParsePerfdata("a=1;;;;;")
+		assert.EqualError(t, err, `invalid perfdata "a=1;;;;;": too many ';' separated fields`)
+	})
+}
+
+func TestParseRange(t *testing.T) {
+	t.Run("The range forms from the plugin guidelines are parsed", func(t *testing.T) {
+		parsed, _ := ParseRange("10")
+		assert.Equal(t, 0.0, parsed.Start)
+		assert.Equal(t, 10.0, parsed.End)
+
+		parsed, _ = ParseRange("10:")
+		assert.Equal(t, 10.0, parsed.Start)
+		assert.Equal(t, math.Inf(1), parsed.End)
+
+		parsed, _ = ParseRange("~:20")
+		assert.Equal(t, math.Inf(-1), parsed.Start)
+		assert.Equal(t, 20.0, parsed.End)
+
+		parsed, _ = ParseRange("@5:10")
+		assert.True(t, parsed.Inside)
+		assert.Equal(t, 5.0, parsed.Start)
+		assert.Equal(t, 10.0, parsed.End)
+		assert.Equal(t, "@5:10", parsed.String())
+	})
+}
+
+func TestRangeAlerts(t *testing.T) {
+	t.Run("Values outside the range alert unless it is inverted with @", func(t *testing.T) {
+		for _, testCase := range []struct {
+			rangeValue string
+			value      float64
+			alerts     bool
+		}{
+			{"10", -1, true},
+			{"10", 0, false},
+			{"10", 10, false},
+			{"10", 10.5, true},
+			{"10:", 9, true},
+			{"10:", 1000, false},
+			{"~:20", -1000, false},
+			{"~:20", 21, true},
+			{"@5:10", 5, true},
+			{"@5:10", 11, false},
+		} {
+			parsed, err := ParseRange(testCase.rangeValue)
+			assert.Nil(t, err)
+			assert.Equal(t, testCase.alerts, parsed.Alerts(testCase.value), "%s with %v", testCase.rangeValue, testCase.value)
+		}
+	})
+}
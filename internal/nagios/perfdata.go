@@ -0,0 +1,167 @@
+package nagios
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Perfdata is a single 'label'=value[UOM];[warn];[crit];[min];[max] item, the
+// fields are kept as they were written so rendering does not alter them
+type Perfdata struct {
+	Label    string
+	Value    string
+	UOM      string
+	Warning  string
+	Critical string
+	Min      string
+	Max      string
+}
+
+var perfdataValuePattern = regexp.MustCompile(`^(-?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?|U)([a-zA-Z%]*)$`)
+
+func ParsePerfdata(item string) (Perfdata, error) {
+	label, remaining, err := splitLabel(item)
+	if err != nil {
+		return Perfdata{}, err
+	}
+
+	fields := strings.Split(remaining, ";")
+	if len(fields) > 5 {
+		return Perfdata{}, fmt.Errorf("invalid perfdata %q: too many ';' separated fields", item)
+	}
+	for len(fields) < 5 {
+		fields = append(fields, "")
+	}
+
+	match := perfdataValuePattern.FindStringSubmatch(fields[0])
+	if match == nil {
+		return Perfdata{}, fmt.Errorf("invalid perfdata %q: value %q is not a number with an optional unit", item, fields[0])
+	}
+
+	parsed := Perfdata{
+		Label:    label,
+		Value:    match[1],
+		UOM:      match[2],
+		Warning:  fields[1],
+		Critical: fields[2],
+		Min:      fields[3],
+		Max:      fields[4],
+	}
+
+	for _, threshold := range []string{parsed.Warning, parsed.Critical} {
+		if threshold == "" {
+			continue
+		}
+		if _, err := ParseRange(threshold); err != nil {
+			return Perfdata{}, fmt.Errorf("invalid perfdata %q: %s", item, err)
+		}
+	}
+	for _, limit := range []string{parsed.Min, parsed.Max} {
+		if limit == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(limit, 64); err != nil {
+			return Perfdata{}, fmt.Errorf("invalid perfdata %q: min/max %q is not a number", item, limit)
+		}
+	}
+
+	return parsed, nil
+}
+
+// ParsePerfdataList parses a whitespace separated perfdata section, every
+// valid item is returned even when others fail to parse
+func ParsePerfdataList(section string) ([]Perfdata, error) {
+	var parsed []Perfdata
+	var failures []string
+
+	for _, item := range splitPerfdataItems(section) {
+		perfdata, err := ParsePerfdata(item)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		parsed = append(parsed, perfdata)
+	}
+
+	if len(failures) > 0 {
+		return parsed, fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return parsed, nil
+}
+
+// Number returns the value as a float, "U" (unknown) is reported as an error
+func (p Perfdata) Number() (float64, error) {
+	return strconv.ParseFloat(p.Value, 64)
+}
+
+func (p Perfdata) String() string {
+	label := p.Label
+	if strings.ContainsAny(label, " ='") {
+		label = "'" + strings.ReplaceAll(label, "'", "''") + "'"
+	}
+	fields := strings.Join([]string{p.Value + p.UOM, p.Warning, p.Critical, p.Min, p.Max}, ";")
+	return label + "=" + strings.TrimRight(fields, ";")
+}
+
+func splitLabel(item string) (string, string, error) {
+	if strings.HasPrefix(item, "'") {
+		var label strings.Builder
+		for index := 1; index < len(item); index++ {
+			if item[index] != '\'' {
+				label.WriteByte(item[index])
+				continue
+			}
+			if index+1 < len(item) && item[index+1] == '\'' {
+				label.WriteByte('\'')
+				index++
+				continue
+			}
+			if index+1 >= len(item) || item[index+1] != '=' {
+				return "", "", fmt.Errorf("invalid perfdata %q: expected '=' after the quoted label", item)
+			}
+			if label.Len() == 0 {
+				return "", "", fmt.Errorf("invalid perfdata %q: the label is empty", item)
+			}
+			return label.String(), item[index+2:], nil
+		}
+		return "", "", fmt.Errorf("invalid perfdata %q: the label quote is not closed", item)
+	}
+
+	index := strings.Index(item, "=")
+	if index == -1 {
+		return "", "", fmt.Errorf("invalid perfdata %q: expected label=value", item)
+	}
+	if index == 0 {
+		return "", "", fmt.Errorf("invalid perfdata %q: the label is empty", item)
+	}
+	return item[:index], item[index+1:], nil
+}
+
+// splitPerfdataItems splits on whitespace outside of quoted labels
+func splitPerfdataItems(section string) []string {
+	var items []string
+	var current strings.Builder
+	quoted := false
+
+	for _, character := range section {
+		switch {
+		case character == '\'':
+			quoted = !quoted
+			current.WriteRune(character)
+		case !quoted && (character == ' ' || character == '\t' || character == '\r' || character == '\n'):
+			if current.Len() > 0 {
+				items = append(items, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(character)
+		}
+	}
+	if current.Len() > 0 {
+		items = append(items, current.String())
+	}
+
+	return items
+}
@@ -0,0 +1,76 @@
+package nagios
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Range is a threshold in the Nagios plugin range format, e.g. "10", "10:",
+// "~:20", "5:10" or "@5:10"
+type Range struct {
+	Start  float64
+	End    float64
+	Inside bool
+	raw    string
+}
+
+func ParseRange(value string) (Range, error) {
+	parsed := Range{Start: 0, End: math.Inf(1), raw: value}
+
+	remaining := value
+	if strings.HasPrefix(remaining, "@") {
+		parsed.Inside = true
+		remaining = remaining[1:]
+	}
+	if remaining == "" {
+		return Range{}, fmt.Errorf("invalid range %q: it is empty", value)
+	}
+
+	start, end := "", remaining
+	if index := strings.Index(remaining, ":"); index != -1 {
+		start, end = remaining[:index], remaining[index+1:]
+		if start == "" {
+			return Range{}, fmt.Errorf("invalid range %q: the start is missing before ':'", value)
+		}
+	}
+
+	if start == "~" {
+		parsed.Start = math.Inf(-1)
+	} else if start != "" {
+		number, err := strconv.ParseFloat(start, 64)
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid range %q: start %q is not a number", value, start)
+		}
+		parsed.Start = number
+	}
+
+	if end != "" {
+		number, err := strconv.ParseFloat(end, 64)
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid range %q: end %q is not a number", value, end)
+		}
+		parsed.End = number
+	}
+
+	if parsed.Start > parsed.End {
+		return Range{}, fmt.Errorf("invalid range %q: start is greater than end", value)
+	}
+
+	return parsed, nil
+}
+
+func (r Range) String() string {
+	return r.raw
+}
+
+// Alerts reports whether the value should raise an alert, values outside the
+// range alert unless it starts with @ in which case values inside it do
+func (r Range) Alerts(value float64) bool {
+	inside := value >= r.Start && value <= r.End
+	if r.Inside {
+		return inside
+	}
+	return !inside
+}
@@ -0,0 +1,124 @@
+package pnp4nagios
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"monitoring-agent-client/internal/nagios"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var lineColours = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+// GenerateTemplate builds a pnp4nagios PHP template with one graph per unit of
+// measurement, data sources are numbered in the order the perfdata is emitted
+// which is how pnp4nagios numbers them in the RRD
+func GenerateTemplate(name string, perfdata []nagios.Perfdata) string {
+	var template strings.Builder
+
+	labels := make([]string, len(perfdata))
+	for index, item := range perfdata {
+		labels[index] = strings.ReplaceAll(item.Label, "?>", "? >")
+	}
+
+	fmt.Fprintf(&template, "<?php\n#\n# %s, generated by monitoring-agent-client from: %s\n#\n", name, strings.Join(labels, ", "))
+
+	var units []string
+	dataSourcesByUnit := map[string][]int{}
+	for index, item := range perfdata {
+		if _, found := dataSourcesByUnit[item.UOM]; !found {
+			units = append(units, item.UOM)
+		}
+		dataSourcesByUnit[item.UOM] = append(dataSourcesByUnit[item.UOM], index+1)
+	}
+
+	for graphIndex, unit := range units {
+		graph := graphIndex + 1
+		dataSources := dataSourcesByUnit[unit]
+
+		title := phpEscape(perfdata[dataSources[0]-1].Label)
+		if len(dataSources) > 1 {
+			title = phpEscape(unit)
+			if unit == "" {
+				title = "values"
+			}
+		}
+
+		fmt.Fprintf(&template, "\n$ds_name[%d] = \"%s\";\n", graph, title)
+		fmt.Fprintf(&template, "$opt[%d] = \"--vertical-label \\\"%s\\\" --title \\\"$hostname / $servicedesc: %s\\\" \";\n", graph, phpEscape(unit), title)
+		fmt.Fprintf(&template, "$def[%d] = \"\";\n", graph)
+
+		for lineIndex, dataSource := range dataSources {
+			label := phpEscape(perfdata[dataSource-1].Label)
+			colour := lineColours[lineIndex%len(lineColours)]
+			fmt.Fprintf(&template, "$def[%d] .= rrd::def(\"var%d\", $RRDFILE[%d], $DS[%d], \"AVERAGE\");\n", graph, dataSource, dataSource, dataSource)
+			fmt.Fprintf(&template, "$def[%d] .= rrd::line1(\"var%d\", \"%s\", \"%s\");\n", graph, dataSource, colour, label)
+			fmt.Fprintf(&template, "$def[%d] .= rrd::gprint(\"var%d\", array(\"LAST\", \"MAX\", \"AVERAGE\"), \"%%6.2lf $UNIT[%d]\");\n", graph, dataSource, dataSource)
+		}
+
+		if len(dataSources) == 1 {
+			dataSource := dataSources[0]
+			fmt.Fprintf(&template, "if ($WARN[%d] != \"\") {\n\t$def[%d] .= rrd::hrule($WARN[%d], \"#FFFF00\", \"Warning  $WARN[%d] \\\\n\");\n}\n", dataSource, graph, dataSource, dataSource)
+			fmt.Fprintf(&template, "if ($CRIT[%d] != \"\") {\n\t$def[%d] .= rrd::hrule($CRIT[%d], \"#FF0000\", \"Critical $CRIT[%d] \\\\n\");\n}\n", dataSource, graph, dataSource, dataSource)
+		}
+	}
+
+	template.WriteString("?>\n")
+
+	return template.String()
+}
+
+// WriteTemplate writes <directory>/<name>.php, an existing template is only
+// replaced when overwrite is set so hand tuned templates are never clobbered
+func WriteTemplate(directory string, name string, perfdata []nagios.Perfdata, overwrite bool) (bool, error) {
+	if !templateNamePattern.MatchString(name) {
+		return false, fmt.Errorf("invalid template name %q, only letters, digits, '_', '.' and '-' are allowed", name)
+	}
+	if len(perfdata) == 0 {
+		return false, errors.New("no perfdata to build a template from")
+	}
+
+	templatePath := filepath.Join(directory, name+".php")
+	if !overwrite {
+		if _, err := os.Stat(templatePath); err == nil {
+			return false, nil
+		}
+	}
+
+	if err := writeFileAtomically(templatePath, []byte(GenerateTemplate(name, perfdata))); err != nil {
+		return false, fmt.Errorf("error writing template %s: %s", templatePath, err)
+	}
+	return true, nil
+}
+
+// writeFileAtomically writes a temporary file next to path and renames it into
+// place, so pnp4nagios never reads a half written template
+func writeFileAtomically(path string, content []byte) error {
+	temporary, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	if _, err := temporary.Write(content); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Chmod(0644); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), path)
+}
+
+func phpEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(value)
+}
@@ -0,0 +1,105 @@
+package pnp4nagios
+
+import (
+	"io/ioutil"
+	"monitoring-agent-client/internal/nagios"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateTemplate(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		perfdata         []nagios.Perfdata
+		expectedContains []string
+		expectedMissing  []string
+	}{
+		{
+			name:     "A single data source is graphed with its thresholds",
+			perfdata: []nagios.Perfdata{{Label: "/", Value: "2643", UOM: "MB"}},
+			expectedContains: []string{
+				"# check_disk, generated by monitoring-agent-client from: /\n",
+				`$ds_name[1] = "/";`,
+				`$def[1] .= rrd::def("var1", $RRDFILE[1], $DS[1], "AVERAGE");`,
+				`$def[1] .= rrd::line1("var1", "#1f77b4", "/");`,
+				`if ($WARN[1] != "") {`,
+				`if ($CRIT[1] != "") {`,
+			},
+		},
+		{
+			name:     "Data sources sharing a unit share a graph, numbered in the order emitted",
+			perfdata: []nagios.Perfdata{{Label: "read", UOM: "B"}, {Label: "time", UOM: "s"}, {Label: "write", UOM: "B"}},
+			expectedContains: []string{
+				`$ds_name[1] = "B";`,
+				`$def[1] .= rrd::line1("var1", "#1f77b4", "read");`,
+				`$def[1] .= rrd::line1("var3", "#ff7f0e", "write");`,
+				`$ds_name[2] = "time";`,
+				`$def[2] .= rrd::line1("var2", "#1f77b4", "time");`,
+			},
+			expectedMissing: []string{`$WARN[1]`, `$WARN[3]`},
+		},
+		{
+			name:     "Unitless data sources are titled values",
+			perfdata: []nagios.Perfdata{{Label: "a"}, {Label: "b"}},
+			expectedContains: []string{
+				`$ds_name[1] = "values";`,
+			},
+		},
+		{
+			name:     "Labels are escaped for PHP",
+			perfdata: []nagios.Perfdata{{Label: `C:\ "$free" ?>`}},
+			expectedContains: []string{
+				`rrd::line1("var1", "#1f77b4", "C:\\ \"\$free\" ?>");`,
+				"generated by monitoring-agent-client from: C:\\ \"$free\" ? >\n",
+			},
+		},
+	} {
+		template := GenerateTemplate("check_disk", testCase.perfdata)
+
+		assert.True(t, strings.HasPrefix(template, "<?php\n"), testCase.name)
+		assert.True(t, strings.HasSuffix(template, "?>\n"), testCase.name)
+		for _, expected := range testCase.expectedContains {
+			assert.Contains(t, template, expected, testCase.name)
+		}
+		for _, missing := range testCase.expectedMissing {
+			assert.NotContains(t, template, missing, testCase.name)
+		}
+	}
+}
+
+func TestWriteTemplate(t *testing.T) {
+	t.Run("An existing template is only replaced when overwriting", func(t *testing.T) {
+		directory := t.TempDir()
+		templatePath := filepath.Join(directory, "check_disk.php")
+		ioutil.WriteFile(templatePath, []byte("hand tuned"), 0644)
+
+		written, err := WriteTemplate(directory, "check_disk", []nagios.Perfdata{{Label: "/"}}, false)
+		assert.Nil(t, err)
+		assert.False(t, written)
+		content, _ := ioutil.ReadFile(templatePath)
+		assert.Equal(t, "hand tuned", string(content))
+
+		written, err = WriteTemplate(directory, "check_disk", []nagios.Perfdata{{Label: "/"}}, true)
+		assert.Nil(t, err)
+		assert.True(t, written)
+		content, _ = ioutil.ReadFile(templatePath)
+		assert.Equal(t, GenerateTemplate("check_disk", []nagios.Perfdata{{Label: "/"}}), string(content))
+
+		info, _ := os.Stat(templatePath)
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+		entries, _ := ioutil.ReadDir(directory)
+		assert.Equal(t, 1, len(entries), "the temporary file is left behind")
+	})
+
+	t.Run("Invalid names and missing perfdata are rejected", func(t *testing.T) {
+		_, err := WriteTemplate(t.TempDir(), "../check_disk", []nagios.Perfdata{{Label: "/"}}, false)
+		assert.EqualError(t, err, `invalid template name "../check_disk", only letters, digits, '_', '.' and '-' are allowed`)
+
+		_, err = WriteTemplate(t.TempDir(), "check_disk", nil, false)
+		assert.EqualError(t, err, "no perfdata to build a template from")
+	})
+}
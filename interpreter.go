@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// interpreterProfile describes how the agent should run a type of script fed
+// to it on stdin
+type interpreterProfile struct {
+	name           string
+	executable     string
+	executableArgs []string
+	extensions     []string
+	shebangs       []string
+	validate       func(scriptContent string) error
+	normalise      func(scriptContent string, lineEnding string) string
+	warnings       func(scriptContent string) []string
+}
+
+var interpreterProfiles = []interpreterProfile{
+	{
+		name:           "powershell",
+		executable:     `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`,
+		executableArgs: []string{"-command", "-"},
+		extensions:     []string{".ps1"},
+		validate:       validatePowershell,
+		normalise:      normalisePowershell,
+		warnings:       powershellWarnings,
+	},
+	{
+		name:           "pwsh",
+		executable:     "pwsh",
+		executableArgs: []string{"-command", "-"},
+		shebangs:       []string{"pwsh"},
+		validate:       validatePowershell,
+		normalise:      normalisePowershell,
+		warnings:       powershellWarnings,
+	},
+	{
+		name:           "perl",
+		executable:     "perl",
+		executableArgs: []string{"-"},
+		extensions:     []string{".pl"},
+		shebangs:       []string{"perl"},
+	},
+	{
+		name:           "python",
+		executable:     "python3",
+		executableArgs: []string{"-"},
+		extensions:     []string{".py"},
+		shebangs:       []string{"python", "python3"},
+	},
+	{
+		name:           "bash",
+		executable:     "/bin/bash",
+		executableArgs: []string{"-s"},
+		extensions:     []string{".sh"},
+		shebangs:       []string{"bash", "sh"},
+	},
+	{
+		name:           "cmd",
+		executable:     `C:\Windows\System32\cmd.exe`,
+		executableArgs: []string{"/Q"},
+		extensions:     []string{".cmd", ".bat"},
+	},
+}
+
+func findInterpreterProfile(name string) (interpreterProfile, error) {
+	for _, profile := range interpreterProfiles {
+		if profile.name == name {
+			return profile, nil
+		}
+	}
+	names := make([]string, len(interpreterProfiles))
+	for index, profile := range interpreterProfiles {
+		names[index] = profile.name
+	}
+	return interpreterProfile{}, fmt.Errorf("unknown interpreter %q, expected one of: %s", name, strings.Join(names, ", "))
+}
+
+// detectInterpreterProfile picks a profile from the shebang, which says more
+// about how a script expects to be run than its extension does
+func detectInterpreterProfile(scriptPath string, scriptContent string) (interpreterProfile, bool) {
+	if interpreter := shebangInterpreter(scriptContent); interpreter != "" {
+		for _, profile := range interpreterProfiles {
+			for _, shebang := range profile.shebangs {
+				if shebang == interpreter {
+					return profile, true
+				}
+			}
+		}
+	}
+
+	extension := strings.ToLower(filepath.Ext(scriptPath))
+	for _, profile := range interpreterProfiles {
+		for _, profileExtension := range profile.extensions {
+			if profileExtension == extension {
+				return profile, true
+			}
+		}
+	}
+
+	return interpreterProfile{}, false
+}
+
+// shebangInterpreter returns the interpreter's name from a "#!/usr/bin/perl"
+// or "#!/usr/bin/env python3" style first line
+func shebangInterpreter(scriptContent string) string {
+	if !strings.HasPrefix(scriptContent, "#!") {
+		return ""
+	}
+	firstLine := strings.SplitN(scriptContent[2:], "\n", 2)[0]
+	fields := strings.Fields(strings.TrimSuffix(firstLine, "\r"))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	interpreter := filepath.Base(strings.ReplaceAll(fields[0], `\`, "/"))
+	if interpreter == "env" {
+		interpreter = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				interpreter = filepath.Base(field)
+				break
+			}
+		}
+	}
+	return interpreter
+}
+
+func validatePowershell(scriptContent string) error {
+	if !strings.HasSuffix(scriptContent, "\r\n\r\n") && !strings.HasSuffix(scriptContent, "\n\n") {
+		return errors.New("Invalid powershell script, the script must end with two blank lines")
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// knownAgentsLockTimeout is how long to wait for another client to finish
+// writing the known agents file
+var knownAgentsLockTimeout = 5 * time.Second
+
+// knownAgents is the trust on first use store, a file of "host:port pin"
+// lines like ssh's known_hosts. The pin is the same public key hash as -pin.
+type knownAgents struct {
+	path string
+}
+
+// knownAgentMismatchError is returned from the TLS handshake when an agent
+// presents a different key to the one recorded for it
+type knownAgentMismatchError struct {
+	address   string
+	known     string
+	presented string
+	path      string
+}
+
+func (e knownAgentMismatchError) Error() string {
+	return fmt.Sprintf("the certificate of %s has changed, %s has %s but the agent presented %s", e.address, e.path, e.known, e.presented)
+}
+
+func defaultKnownAgentsPath() string {
+	if path := os.Getenv("MONITORING_AGENT_KNOWN_AGENTS"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "known_agents"
+	}
+	return filepath.Join(home, ".monitoring-agent-client", "known_agents")
+}
+
+// read returns the recorded pins by address, a missing file has none
+func (store *knownAgents) read() (map[string]string, error) {
+	entries := map[string]string{}
+
+	file, err := os.Open(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading known agents: %s", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("error parsing %s line %d, expected host:port pin", store.path, lineNumber)
+		}
+		entries[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading known agents %s: %s", store.path, err)
+	}
+	return entries, nil
+}
+
+// update changes the entries while holding the lock, the file is replaced in
+// one rename so it can be read without taking the lock
+func (store *knownAgents) update(change func(entries map[string]string) error) error {
+	if err := os.MkdirAll(filepath.Dir(store.path), 0700); err != nil {
+		return fmt.Errorf("error creating the known agents directory: %s", err)
+	}
+
+	unlock, err := lockFile(store.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := store.read()
+	if err != nil {
+		return err
+	}
+	if err := change(entries); err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	for _, address := range sortedAddresses(entries) {
+		fmt.Fprintf(&content, "%s %s\n", address, entries[address])
+	}
+
+	temporaryPath := fmt.Sprintf("%s.%d.tmp", store.path, os.Getpid())
+	if err := ioutil.WriteFile(temporaryPath, []byte(content.String()), 0600); err != nil {
+		return fmt.Errorf("error writing known agents: %s", err)
+	}
+	if err := os.Rename(temporaryPath, store.path); err != nil {
+		os.Remove(temporaryPath)
+		return fmt.Errorf("error writing known agents: %s", err)
+	}
+	return nil
+}
+
+// verify accepts the agent's key if it matches the recorded one, recording it
+// on first contact
+func (store *knownAgents) verify(address string, certificate *x509.Certificate) error {
+	presented := publicKeyPin(certificate)
+
+	entries, err := store.read()
+	if err != nil {
+		return err
+	}
+	if known, found := entries[address]; found {
+		if !samePublicKeyPin(known, presented) {
+			return knownAgentMismatchError{address: address, known: known, presented: presented, path: store.path}
+		}
+		return nil
+	}
+
+	return store.update(func(entries map[string]string) error {
+		// another client may have got here first
+		if known, found := entries[address]; found && !samePublicKeyPin(known, presented) {
+			return knownAgentMismatchError{address: address, known: known, presented: presented, path: store.path}
+		}
+		if _, found := entries[address]; !found {
+			fmt.Fprintf(stderr, "warning: %s was not known, recorded %s in %s\n", address, presented, store.path)
+		}
+		entries[address] = presented
+		return nil
+	})
+}
+
+// dialTLS is the transport's DialTLSContext when -tofu is set, it does the
+// handshake the transport would but with the address available to verify
+func (store *knownAgents) dialTLS(ctx context.Context, dialer *net.Dialer, base *tls.Config, handshakeTimeout time.Duration, network string, address string) (net.Conn, error) {
+	connection, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+
+	config := base.Clone()
+	config.InsecureSkipVerify = true
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	config.VerifyPeerCertificate = func(rawCertificates [][]byte, chains [][]*x509.Certificate) error {
+		if base.VerifyPeerCertificate != nil {
+			if err := base.VerifyPeerCertificate(rawCertificates, chains); err != nil {
+				return err
+			}
+		}
+		if len(rawCertificates) == 0 {
+			return fmt.Errorf("the agent did not present a certificate")
+		}
+		certificate, err := x509.ParseCertificate(rawCertificates[0])
+		if err != nil {
+			return fmt.Errorf("could not parse the agent's certificate: %s", err)
+		}
+		return store.verify(address, certificate)
+	}
+
+	handshakeCtx := ctx
+	if handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		handshakeCtx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+	}
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	tlsConnection := tls.Client(connection, config)
+	err = tlsConnection.HandshakeContext(handshakeCtx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConnection.ConnectionState(), err)
+	}
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return tlsConnection, nil
+}
+
+// lockFile takes an OS lock on path.lock, the lock file itself is left in
+// place as removing it would let two clients lock different files
+func lockFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error locking %s: %s", path, err)
+	}
+
+	deadline := time.Now().Add(knownAgentsLockTimeout)
+	for {
+		locked, err := tryLock(lock)
+		if err != nil {
+			lock.Close()
+			return nil, fmt.Errorf("error locking %s: %s", path, err)
+		}
+		if locked {
+			return func() {
+				unlockFile(lock)
+				lock.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			lock.Close()
+			return nil, fmt.Errorf("timed out waiting for another client to unlock %s", lockPath)
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+}
+
+// sortedAddresses orders the entries for writing and listing
+func sortedAddresses(entries map[string]string) []string {
+	addresses := make([]string, 0, len(entries))
+	for address := range entries {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
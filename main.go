@@ -1,152 +1,358 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"monitoring-agent-client/internal/httpclient"
-	"net/http"
 	"os"
-	"strings"
+	"path/filepath"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if subcommand, found := subcommands[os.Args[1]]; found {
+			os.Exit(subcommand(os.Stdout, os.Stdin, os.Args[2:]))
+		}
+	}
+
 	httpClient := httpclient.NewHTTPClient()
 	os.Exit(invokeClient(os.Stdout, httpClient))
 }
 
 func invokeClient(stdout io.Writer, httpClient httpclient.Interface) int {
-	_ = flag.String("template", "", "pnp4nagios template")
+	template := flag.String("template", "", "pnp4nagios template name")
+	templateDirectory := flag.String("template-directory", os.Getenv("MONITORING_AGENT_TEMPLATE_DIRECTORY"), "pnp4nagios templates directory, the -template is generated there from the perfdata when missing")
 
-	hostname := flag.String("host", "", "hostname or ip")
+	var hosts repeatedArguments
+	flag.Var(&hosts, "host", "hostname or ip, optionally with a :port, specify multiple times to run the script against each host and aggregate the results")
+	hostsFile := flag.String("hosts-file", "", "file listing hosts to run the script against, one per line")
+	concurrency := flag.Int("concurrency", 10, "maximum number of hosts contacted at once when running against several hosts")
+	aggregate := flag.String("aggregate", "worst", "state of a check run against several hosts: worst, best, atleast:<hosts> OK or percent:<percentage> OK")
+	unreachableState := flag.String("unreachable-state", "", "state hosts that could not be contacted count as when aggregating, their failure state when not set")
 	port := flag.Int("port", 9000, "port number")
 	username := flag.String("username", os.Getenv("MONITORING_AGENT_USERNAME"), "username")
-	password := flag.String("password", os.Getenv("MONITORING_AGENT_PASSWORD"), "password")
-	executable := flag.String("executable", "", "executable path")
-	script := flag.String("script", "", "script location")
-
-	cacertificateFilePath := flag.String("cacert", os.Getenv("MONITORING_AGENT_CA_CERTIFICATE_PATH"), "CA certificate")
-	certificateFilePath := flag.String("certificate", os.Getenv("MONITORING_AGENT_CLIENT_CERTIFICATE_PATH"), "certificate file")
-	privateKeyFilePath := flag.String("key", os.Getenv("MONITORING_AGENT_CLIENT_KEY_PATH"), "key file")
-	timeoutString := flag.String("timeout", "10s", "timeout (e.g. 10s)")
+	password := flag.String("password", os.Getenv("MONITORING_AGENT_PASSWORD"), "password, visible to other users in the process list, prefer -password-file, -password-stdin or -credential-helper")
+	passwordFile := flag.String("password-file", os.Getenv("MONITORING_AGENT_PASSWORD_FILE"), "file containing the password")
+	passwordStdin := flag.Bool("password-stdin", false, "read the password from the first line of stdin")
+	credentialHelper := flag.String("credential-helper", os.Getenv("MONITORING_AGENT_CREDENTIAL_HELPER"), "command run through the shell with get appended to look up each agent's password, given protocol, host, port and username lines on stdin like a git credential helper")
+	executable := flag.String("executable", "", "executable path, defaults to the interpreter for the script type")
+	interpreter := flag.String("interpreter", "", "interpreter profile (powershell, pwsh, perl, python, bash, cmd), detected from the shebang or extension when not set")
+	script := flag.String("script", "", "script location, on the agent with -mode script")
+	probe := flag.Bool("probe", false, "only check the agent is up and the credentials are accepted, reporting its version and response time without running anything")
+	probePath := flag.String("probe-path", runScriptStdinPath, "agent endpoint queried by -probe, the default only runs scripts on POST so the probe's GET runs nothing")
+	checkCertificates := flag.Bool("check-certs", false, "report on the agent's certificate chain and the client certificate instead of running anything")
+	certificateWarningDays := flag.Int("cert-warning", 30, "warn when a certificate checked by -check-certs expires within this many days")
+	certificateCriticalDays := flag.Int("cert-critical", 7, "critical when a certificate checked by -check-certs expires within this many days")
+	mode := flag.String("mode", modeStdin, "how the agent runs the check: stdin sends the -script to the -executable, script runs a -script already on the agent, executable runs the -executable with its arguments")
+
+	var caCertificateFilePaths repeatedArguments
+	flag.Var(&caCertificateFilePaths, "cacert", "CA certificate file, which may hold several certificates, specify multiple times to trust several CAs")
+	caDirectory := flag.String("cadir", os.Getenv("MONITORING_AGENT_CA_DIRECTORY"), "directory of CA certificate files (.pem, .crt, .cer) to trust")
+	caSystem := flag.Bool("ca-system", false, "trust the system's CA certificates as well as -cacert and -cadir, rather than only those")
+	certificateFilePath := flag.String("certificate", os.Getenv("MONITORING_AGENT_CLIENT_CERTIFICATE_PATH"), "certificate file, or a .p12/.pfx bundle of the certificate and key")
+	privateKeyFilePath := flag.String("key", os.Getenv("MONITORING_AGENT_CLIENT_KEY_PATH"), "key file, which may be encrypted")
+	keyPassphraseFile := flag.String("key-passphrase-file", os.Getenv("MONITORING_AGENT_KEY_PASSPHRASE_FILE"), "file containing the passphrase of an encrypted -key or -certificate bundle, MONITORING_AGENT_KEY_PASSPHRASE is used when neither this nor -key-passphrase-command is set")
+	keyPassphraseCommand := flag.String("key-passphrase-command", "", "command run through the shell that prints the passphrase of an encrypted -key or -certificate bundle")
+	timeoutString := flag.String("timeout", "10s", "remote execution timeout sent to the agent (e.g. 10s)")
+	connectTimeout := flag.Duration("connect-timeout", 5*time.Second, "timeout for establishing the TCP connection")
+	tlsTimeout := flag.Duration("tls-timeout", 5*time.Second, "timeout for the TLS handshake")
+	responseTimeout := flag.Duration("response-timeout", 0, "timeout waiting for response headers once the request is sent (0 uses the total timeout)")
+	totalTimeout := flag.Duration("total-timeout", 0, "overall client deadline (0 pads the remote timeout by -timeout-padding)")
+	timeoutPadding := flag.Duration("timeout-padding", 5*time.Second, "added to the remote timeout to derive the overall client deadline")
+	normalise := flag.Bool("normalise", false, "fix the script up before sending it: strip a UTF-8 BOM, convert -line-endings and add the blank lines powershell needs")
+	lineEndings := flag.String("line-endings", "keep", "line endings to convert the script to when normalising (keep, crlf, lf)")
+	minisignPublicKey := flag.String("minisign-pubkey", os.Getenv("MONITORING_AGENT_MINISIGN_PUBLIC_KEY"), "minisign public key, or a file containing it, the script's signature is verified against it before contacting the agent")
 	makeInsecure := flag.Bool("insecure", false, "ignore TLS Certificate checks")
+	serverName := flag.String("servername", "", "name sent as the TLS SNI and verified against the agent's certificate, defaults to the host")
+	tlsMinVersion := flag.String("tls-min-version", "", "minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	tlsMaxVersion := flag.String("tls-max-version", "", "maximum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	tlsCiphers := flag.String("tls-ciphers", "", "comma separated cipher suites allowed for TLS 1.2 and below, e.g. TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	tlsCurves := flag.String("tls-curves", "", "comma separated key exchange curves in order of preference (X25519, P256, P384, P521)")
+	tofu := flag.Bool("tofu", false, "trust the agent's certificate on first use, recording its public key in -known-agents and rejecting a different one afterwards, instead of verifying it against the CA and hostname")
+	knownAgentsPath := flag.String("known-agents", defaultKnownAgentsPath(), "known agents file used by -tofu")
+	var pinArgs repeatedArguments
+	flag.Var(&pinArgs, "pin", "accept the agent's certificate only if its public key matches sha256/<base64 hash>, instead of verifying it against the CA and hostname, specify multiple times")
+	responseDecoding := flag.String("response-decoding", "strict", "strict rejects responses with unknown fields, tolerant shows them in the long output")
+	clientPerfdata := flag.Bool("client-perfdata", false, "append the client's request timings and sizes to the perfdata")
+
+	configFilePath := flag.String("config", os.Getenv("MONITORING_AGENT_CONFIG"), "YAML or JSON config file defining agents and checks")
+	agentName := flag.String("agent", "", "agent profile from the config file")
+	checkName := flag.String("check", "", "check definition from the config file")
+	groupName := flag.String("group", "", "group of hosts from the config file to run the script against")
 
 	var executableArgs executableArguments
 	flag.Var(&executableArgs, "executableArg", "executable arg for multiple specify multiple times")
+	var exitCodeMapArgs repeatedArguments
+	flag.Var(&exitCodeMapArgs, "exit-code-map", "state to report a remote exit code as, e.g. 4=warning, specify multiple times")
+	invert := flag.Bool("invert", false, "swap OK and CRITICAL, for checks of things that must not be happening")
+	statePrefix := flag.Bool("prefix-state", false, "prefix the output with the resulting state when the script did not")
+	var warningArgs repeatedArguments
+	flag.Var(&warningArgs, "warning", "warning threshold for a perfdata label in Nagios range syntax, e.g. used=80 or free=10:, specify multiple times")
+	var criticalArgs repeatedArguments
+	flag.Var(&criticalArgs, "critical", "critical threshold for a perfdata label in Nagios range syntax, e.g. used=90 or @5:10, specify multiple times")
+	var errorStateArgs repeatedArguments
+	flag.Var(&errorStateArgs, "error-state", "state to report a failure class as, e.g. auth=critical (classes: dns, refused, connection, timeout, tls, auth, signature, agent-timeout, server, request, response), specify multiple times")
 
 	flag.Parse()
 
-	if *hostname == "" {
+	// the agents' own credentials in the config file don't override these
+	setOnCommandLine := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	defaultScriptArguments, configuration, err := applyConfiguration(flag.CommandLine, *configFilePath, *agentName, *checkName, *groupName)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+	scriptArguments := flag.Args()
+	if len(scriptArguments) == 0 && defaultScriptArguments != nil {
+		scriptArguments = defaultScriptArguments
+	}
+	// a repeatable flag can't default to the environment variable, which is
+	// a list of files like PATH
+	if len(caCertificateFilePaths) == 0 {
+		caCertificateFilePaths = filepath.SplitList(os.Getenv("MONITORING_AGENT_CA_CERTIFICATE_PATH"))
+	}
+
+	addresses, err := agentAddresses(hosts, *hostsFile, *port)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+	if len(addresses) == 0 {
 		return die(stdout, "hostname is not set")
 	}
-	if *password == "" {
-		return die(stdout, "password is not set")
+	if *concurrency < 1 {
+		return die(stdout, "concurrency must be at least 1")
 	}
-	if *executable == "" {
-		return die(stdout, "executable is not set")
+	aggregation, err := parseAggregationPolicy(*aggregate, *unreachableState)
+	if err != nil {
+		return die(stdout, err.Error())
 	}
-	if *script == "" {
-		return die(stdout, "script is not set")
+	if err := aggregation.checkHosts(len(addresses)); err != nil {
+		return die(stdout, err.Error())
 	}
-
-	timeout := enableTimeout(*timeoutString)
-
-	scriptContentByteArray, err := ioutil.ReadFile(*script)
+	if *probe && *checkCertificates {
+		return die(stdout, "-probe and -check-certs cannot be combined")
+	}
+	setByConfiguration := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setByConfiguration[f.Name] = true
+	})
+	passwordSources, err := selectPasswordSources(setOnCommandLine, setByConfiguration)
 	if err != nil {
-		return die(stdout, fmt.Sprintf("error, could not load script file: %s\n", err))
+		return die(stdout, err.Error())
 	}
-	scriptContent := string(scriptContentByteArray)
-
-	if strings.HasSuffix(*script, ".ps1") {
-		if strings.HasSuffix(scriptContent, "\r\n\r\n") == false && strings.HasSuffix(scriptContent, "\n\n") == false {
-			return die(stdout, "Invalid powershell script, the script must end with two blank lines")
+	if passwordSources != nil {
+		if !passwordSources["password-file"] {
+			*passwordFile = ""
+		}
+		if !passwordSources["credential-helper"] {
+			*credentialHelper = ""
 		}
 	}
-
-	restRequest := map[string]interface{}{
-		"path":            executable,
-		"args":            executableArgs,
-		"stdin":           scriptContent,
-		"scriptarguments": flag.Args(),
-		"timeout":         timeoutString,
+	if *passwordStdin {
+		if *password, err = readPasswordStdin(); err != nil {
+			return die(stdout, err.Error())
+		}
+	}
+	configuredHosts, err := hostCredentials(configuration)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+	agentCredentials := &credentials{
+		defaults: credentialSource{
+			username:     *username,
+			password:     *password,
+			passwordFile: *passwordFile,
+			helper:       *credentialHelper,
+		},
+		hosts:        configuredHosts,
+		usernameFlag: setOnCommandLine["username"],
+		passwordFlag: len(setFlags(setOnCommandLine, passwordSourceFlags)) > 0,
+	}
+	for _, address := range addresses {
+		if !agentCredentials.configured(address) && !*checkCertificates {
+			if len(addresses) == 1 {
+				return die(stdout, "password is not set")
+			}
+			return die(stdout, fmt.Sprintf("password is not set for %s", address))
+		}
+	}
+	if !modes[*mode] {
+		return die(stdout, fmt.Sprintf("invalid mode %q, expected stdin, script or executable", *mode))
+	}
+	if *checkCertificates && (*certificateWarningDays < 0 || *certificateCriticalDays < 0) {
+		return die(stdout, "-cert-warning and -cert-critical cannot be negative")
+	}
+	if *checkCertificates && *certificateWarningDays <= *certificateCriticalDays {
+		return die(stdout, fmt.Sprintf("-cert-warning %d must be more than -cert-critical %d, or certificates would never be WARNING", *certificateWarningDays, *certificateCriticalDays))
+	}
+	if *template != "" && *templateDirectory == "" {
+		return die(stdout, "-template requires -template-directory or MONITORING_AGENT_TEMPLATE_DIRECTORY")
+	}
+	if *script == "" && *mode != modeExecutable && !*probe && !*checkCertificates {
+		return die(stdout, "script is not set")
 	}
 
-	url := fmt.Sprintf("https://%s:%d/v1/runscriptstdin", *hostname, *port)
-
-	httpClient.SetTimeout(timeout)
+	pins, err := parsePublicKeyPins(pinArgs)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
 
-	transport := new(http.Transport)
-	transport.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: *makeInsecure,
+	minVersion, err := parseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+	maxVersion, err := parseTLSVersion(*tlsMaxVersion)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return die(stdout, fmt.Sprintf("-tls-min-version %s is above -tls-max-version %s", *tlsMinVersion, *tlsMaxVersion))
+	}
+	cipherSuites, err := parseCipherSuites(*tlsCiphers)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+	curvePreferences, err := parseCurves(*tlsCurves)
+	if err != nil {
+		return die(stdout, err.Error())
 	}
 
-	if *certificateFilePath != "" && *privateKeyFilePath != "" {
-		certificateToLoad, err := tls.LoadX509KeyPair(*certificateFilePath, *privateKeyFilePath)
-		if err != nil {
-			return die(stdout, fmt.Sprintf("error loading certificate pair %s", err.Error()))
-		}
-		transport.TLSClientConfig.Certificates = []tls.Certificate{certificateToLoad}
+	errorStates, err := parseFailureStates(errorStateArgs)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+	if *probe {
+		errorStates.defaultTo(criticalExitCode)
+	}
+	if _, found := errorStates[failureKnownAgent]; !found {
+		errorStates[failureKnownAgent] = criticalExitCode
 	}
 
-	if *cacertificateFilePath != "" {
-		caCertificate, err := ioutil.ReadFile(*cacertificateFilePath)
-		if err != nil {
-			return die(stdout, fmt.Sprintf("error loading ca certificate %s", err.Error()))
-		}
-		CACertificatePool := x509.NewCertPool()
-		CACertificatePool.AppendCertsFromPEM(caCertificate)
-		transport.TLSClientConfig.RootCAs = CACertificatePool
+	var knownAgentsStore *knownAgents
+	if *tofu {
+		knownAgentsStore = &knownAgents{path: *knownAgentsPath}
 	}
 
-	scriptSignatureFilename := fmt.Sprintf("%s%s", *script, ".minisig")
-	if FileExists(scriptSignatureFilename) {
-		scriptSignatureContent, err := ioutil.ReadFile(scriptSignatureFilename)
-		if err != nil {
-			return die(stdout, fmt.Sprintf("error loading script signature: %s", err.Error()))
-		}
-		restRequest["stdinsignature"] = string(scriptSignatureContent)
+	exitCodes, err := parseExitCodeMapping(exitCodeMapArgs, *invert)
+	if err != nil {
+		return die(stdout, err.Error())
 	}
 
-	httpClient.SetTransport(transport)
+	thresholds, err := parseThresholdRules(warningArgs, criticalArgs)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
 
-	byteArray, _ := json.Marshal(restRequest)
-	byteArrayBuffer := bytes.NewBuffer(byteArray)
+	if *responseDecoding != "strict" && *responseDecoding != "tolerant" {
+		return die(stdout, fmt.Sprintf("invalid response decoding %q, expected strict or tolerant", *responseDecoding))
+	}
 
-	req, err := http.NewRequest(http.MethodPost, url, byteArrayBuffer)
+	remoteTimeout, err := time.ParseDuration(*timeoutString)
 	if err != nil {
-		panic(fmt.Errorf("got http request error %s", err.Error()))
+		return die(stdout, fmt.Sprintf("error parsing timeout value %s", err.Error()))
 	}
-	req.SetBasicAuth(*username, *password)
 
-	response, err := httpClient.Do(req)
+	timeouts := clientTimeouts{
+		connect:  *connectTimeout,
+		tls:      *tlsTimeout,
+		response: *responseTimeout,
+		total:    *totalTimeout,
+	}
+	if timeouts.total == 0 {
+		timeouts.total = remoteTimeout + *timeoutPadding
+	}
 
+	transport, err := newTransport(transportSettings{
+		timeouts:               timeouts,
+		insecure:               *makeInsecure,
+		caCertificateFilePaths: caCertificateFilePaths,
+		caDirectory:            *caDirectory,
+		caSystem:               *caSystem,
+		certificateFilePath:    *certificateFilePath,
+		privateKeyFilePath:     *privateKeyFilePath,
+		keyPassphrase:          keyPassphrase{file: *keyPassphraseFile, command: *keyPassphraseCommand},
+		serverName:             *serverName,
+		minVersion:             minVersion,
+		maxVersion:             maxVersion,
+		cipherSuites:           cipherSuites,
+		curvePreferences:       curvePreferences,
+		pins:                   pins,
+		knownAgents:            knownAgentsStore,
+	})
 	if err != nil {
-		return die(stdout, fmt.Sprintf("got httpClient error %s", err.Error()))
+		return die(stdout, err.Error())
 	}
+	httpClient.SetTransport(transport)
 
-	defer response.Body.Close()
+	check := &agentCheck{
+		httpClient:     httpClient,
+		path:           runScriptStdinPath,
+		credentials:    agentCredentials,
+		timeouts:       timeouts,
+		errorStates:    errorStates,
+		tolerant:       *responseDecoding == "tolerant",
+		exitCodes:      exitCodes,
+		thresholds:     thresholds,
+		clientPerfdata: *clientPerfdata,
+	}
 
-	if response.StatusCode != 200 {
-		errorBodyContent, _ := ioutil.ReadAll(response.Body)
-		return die(stdout, fmt.Sprintf("Response code: %d\n%s", response.StatusCode, errorBodyContent))
+	var checker hostChecker = check
+	switch {
+	case *checkCertificates:
+		checker = &certificateCheck{
+			transport:    transport,
+			timeouts:     timeouts,
+			insecure:     *makeInsecure,
+			pinned:       len(pins) > 0,
+			knownAgents:  knownAgentsStore,
+			warningDays:  *certificateWarningDays,
+			criticalDays: *certificateCriticalDays,
+			errorStates:  errorStates,
+		}
+	case *probe:
+		check.path = *probePath
+		check.probe = true
+	default:
+		check.requestBody, err = runRequestBody(scriptOptions{
+			mode:              *mode,
+			script:            *script,
+			interpreter:       *interpreter,
+			executable:        *executable,
+			executableArgs:    executableArgs,
+			scriptArguments:   scriptArguments,
+			timeout:           *timeoutString,
+			normalise:         *normalise,
+			lineEndings:       *lineEndings,
+			minisignPublicKey: *minisignPublicKey,
+		})
+		if err != nil {
+			return die(stdout, err.Error())
+		}
 	}
 
-	var decodedResponse MonitoringAgentResponse
+	if len(addresses) > 1 {
+		output, state := aggregateResults(fanOut(checker, addresses, *concurrency), aggregation)
+		fmt.Fprint(stdout, output)
+		return state
+	}
 
-	decoder := json.NewDecoder(response.Body)
-	decoder.DisallowUnknownFields()
-	decoder.Decode(&decodedResponse)
+	result := checker.run(addresses[0])
+	output, state := result.output, result.state
 
-	fmt.Fprint(stdout, decodedResponse.Output)
+	if *template != "" {
+		writeMissingTemplate(*templateDirectory, *template, output)
+	}
 
-	if decodedResponse.Exitcode > unknownExitCode {
-		return unknownExitCode
+	if *statePrefix {
+		output = prefixState(output, state)
 	}
 
-	return decodedResponse.Exitcode
+	fmt.Fprint(stdout, output)
+
+	return state
 }
@@ -2,13 +2,33 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"flag"
+	"io/ioutil"
+	"math/big"
 	"monitoring-agent-client/internal/httpclient"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 func TestArgumentParsing(t *testing.T) {
@@ -35,7 +55,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":null,"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
 		assert.Equal(t, "remotehost:9000", httpClient.RequestHost)
@@ -69,7 +89,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":null,"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, true, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
 		assert.Equal(t, "remotehost:9000", httpClient.RequestHost)
@@ -103,7 +123,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":null,"path":"/path/to/executable","scriptarguments":[],"stdin":"#!/perl\n\nprint \"this is a test script\"\n","stdinsignature":"untrusted comment: signature from minisign secret key\r\nRWTV8L06+shYI3jk77ofKAmdXcat5J7EVM/6JLX3ssHhRFqqIAU1vc49KF9Hn3+kO/+k6bFBND+W40LZM8ae4TtQY2NF6HaBpAI=\r\ntrusted comment: timestamp:1634631414\tfile:TestScript.pl\r\nixE4k+I3rIX1S3aTt/q4rTx9aZUygKYITgPQFkbnq+WPq4TwtW4Q9LmDMr5caG5FlPxWT6ve8rvBjZXxkogHBw==\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
 		assert.Equal(t, "remotehost:9000", httpClient.RequestHost)
@@ -137,7 +157,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":["arg1","arg2"],"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
 		assert.Equal(t, "remotehost:9000", httpClient.RequestHost)
@@ -172,7 +192,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":["arg1","arg2"],"path":"/path/to/executable","scriptarguments":["scriptarg1","-scriptarg scriptarg2","-scriptarg","scriptarg3","--warning=3"],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
 		assert.Equal(t, "remotehost:9000", httpClient.RequestHost)
@@ -204,7 +224,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":null,"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, 1, len(httpClient.Transport.TLSClientConfig.Certificates))
 		assert.NotNil(t, httpClient.Transport.TLSClientConfig.Certificates[0].Certificate)
@@ -239,7 +259,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":null,"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.NotNil(t, httpClient.Transport.TLSClientConfig.RootCAs)
 		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
@@ -273,7 +293,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":null,"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, 1, len(httpClient.Transport.TLSClientConfig.Certificates))
 		assert.NotNil(t, httpClient.Transport.TLSClientConfig.Certificates[0].Certificate)
@@ -313,7 +333,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":["-s"],"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"1s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 1*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(6*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
 		assert.Equal(t, "remotehost:9000", httpClient.RequestHost)
@@ -349,7 +369,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":["-s"],"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
 		assert.Equal(t, "remotehost:9000", httpClient.RequestHost)
@@ -357,7 +377,7 @@ func TestArgumentParsing(t *testing.T) {
 		assert.Equal(t, "POST", httpClient.RequestVerb)
 
 		assert.Equal(t, 3, actualExit)
-		assert.Equal(t, "Response code: 400\n{\"output\": \"Error\", \"exitcode\": 1}", actualOutput)
+		assert.Equal(t, "UNKNOWN - the agent rejected the request (HTTP 400)\n{\"output\": \"Error\", \"exitcode\": 1}", actualOutput)
 	})
 
 	t.Run("A 401 response should be an UNKNOWN exit code", func(t *testing.T) {
@@ -384,7 +404,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":["-s"],"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
 		assert.Equal(t, "remotehost:9000", httpClient.RequestHost)
@@ -392,7 +412,7 @@ func TestArgumentParsing(t *testing.T) {
 		assert.Equal(t, "POST", httpClient.RequestVerb)
 
 		assert.Equal(t, 3, actualExit)
-		assert.Equal(t, "Response code: 401\n{\"output\": \"Error\", \"exitcode\": 1}", actualOutput)
+		assert.Equal(t, "UNKNOWN - authentication failed (HTTP 401), check the username and password\n{\"output\": \"Error\", \"exitcode\": 1}", actualOutput)
 	})
 
 	t.Run("Powershell scripts that don't end with 2 newlines should be rejected", func(t *testing.T) {
@@ -442,7 +462,7 @@ func TestArgumentParsing(t *testing.T) {
 		actualOutput := buf.String()
 
 		assert.Equal(t, `{"args":null,"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\n\n","timeout":"10s"}`, httpClient.RequestBodyContent)
-		assert.Equal(t, 10*time.Second, httpClient.Timeout)
+		assert.WithinDuration(t, time.Now().Add(15*time.Second), httpClient.Deadline, time.Second)
 		assert.Equal(t, false, httpClient.Transport.TLSClientConfig.InsecureSkipVerify)
 		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
 		assert.Equal(t, "remotehost:9000", httpClient.RequestHost)
@@ -452,4 +472,2032 @@ func TestArgumentParsing(t *testing.T) {
 		assert.Equal(t, 2, actualExit)
 		assert.Equal(t, "Test output", actualOutput)
 	})
+
+	t.Run("A client timeout should be an UNKNOWN exit code naming the phase in progress", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-timeout", "50ms",
+			"-timeout-padding", "0s",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+		httpClient.DoFunc = func(r *http.Request) (*http.Response, error) {
+			trace := httptrace.ContextClientTrace(r.Context())
+			trace.GetConn("remotehost:9000")
+			trace.GotConn(httptrace.GotConnInfo{})
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+		actualOutput := buf.String()
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "UNKNOWN - client timeout after 50ms contacting remotehost:9000 (phase: awaiting response)", actualOutput)
+	})
+
+	t.Run("Phase timeouts are applied to the transport and the total deadline can be set explicitly", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-timeout", "30s",
+			"-tls-timeout", "2s",
+			"-response-timeout", "40s",
+			"-total-timeout", "45s",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Contains(t, httpClient.RequestBodyContent, `"timeout":"30s"`)
+		assert.WithinDuration(t, time.Now().Add(45*time.Second), httpClient.Deadline, time.Second)
+		assert.Equal(t, 2*time.Second, httpClient.Transport.TLSHandshakeTimeout)
+		assert.Equal(t, 40*time.Second, httpClient.Transport.ResponseHeaderTimeout)
+		assert.NotNil(t, httpClient.Transport.DialContext)
+	})
+
+	t.Run("A connect timeout is reported separately from the overall client timeout", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-connect-timeout", "3s",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+		httpClient.DoFunc = func(r *http.Request) (*http.Response, error) {
+			httptrace.ContextClientTrace(r.Context()).GetConn("remotehost:9000")
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+		}
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "UNKNOWN - connect timeout after 3s contacting remotehost:9000 (phase: dial)", buf.String())
+	})
+
+	t.Run("Client perfdata is merged with the perfdata the script emitted", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-client-perfdata",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "OK - fine | files=12;20;30\r\nlong output\r\n", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Regexp(t, `^OK - fine \| files=12;20;30 client_time=[0-9.]+s;;;0 client_dns_time=0\.000000s;;;0 client_connect_time=0\.000000s;;;0 client_tls_time=0\.000000s;;;0 client_server_time=0\.000000s;;;0 client_request_bytes=134B;;;0 client_response_bytes=74B;;;0\nlong output$`, buf.String())
+	})
+
+	t.Run("Client perfdata is left out with a note when the script's perfdata cannot be parsed", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-client-perfdata",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "OK - fine | files=twelve", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "OK - fine | files=twelve\nthe client perfdata was left out as the script's perfdata could not be parsed: invalid perfdata \"files=twelve\": value \"twelve\" is not a number with an optional unit", buf.String())
+	})
+
+	t.Run("A missing pnp4nagios template is generated from the returned perfdata", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		templateDirectory := t.TempDir()
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-template", "check_iis",
+			"-template-directory", templateDirectory,
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "OK - fine | requests=12c", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "OK - fine | requests=12c", buf.String())
+		template, err := ioutil.ReadFile(filepath.Join(templateDirectory, "check_iis.php"))
+		assert.Nil(t, err)
+		assert.Contains(t, string(template), `rrd::line1("var1", "#1f77b4", "requests")`)
+	})
+
+	t.Run("A template without a templates directory is rejected", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-template", "check_iis",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "OK - fine | requests=12c", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "-template requires -template-directory or MONITORING_AGENT_TEMPLATE_DIRECTORY", buf.String())
+	})
+
+	t.Run("Agent and check profiles from the config file fill in the flags", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Setenv("MONITORING_AGENT_USERNAME", "environmentusername")
+		defer os.Unsetenv("MONITORING_AGENT_USERNAME")
+		os.Setenv("WEB01_PASSWORD", "thisismypassword")
+		defer os.Unsetenv("WEB01_PASSWORD")
+
+		configFilePath := filepath.Join(t.TempDir(), "mac.yaml")
+		ioutil.WriteFile(configFilePath, []byte(`
+agents:
+  web01:
+    host: web01.example.com
+    port: 9001
+    username: thisismyusername
+    passwordEnv: WEB01_PASSWORD
+checks:
+  disk:
+    script: TestScript-Valid.ps1
+    executable: /path/to/executable
+    executableArgs: [-command, "-"]
+    scriptArgs: [-warning, "80"]
+    timeout: 30s
+`), 0644)
+
+		os.Args = []string{
+			"main.exe",
+			"-config", configFilePath,
+			"-agent", "web01",
+			"-check", "disk",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, `{"args":["-command","-"],"path":"/path/to/executable","scriptarguments":["-warning","80"],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"30s"}`, httpClient.RequestBodyContent)
+		assert.Equal(t, "web01.example.com:9001", httpClient.RequestHost)
+		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
+	})
+
+	t.Run("Flags take precedence over the JSON config file", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		configFilePath := filepath.Join(t.TempDir(), "mac.json")
+		ioutil.WriteFile(configFilePath, []byte(`{
+			"agents": {"web01": {"port": 9001, "username": "thisismyusername", "password": "thisismypassword"}},
+			"checks": {"disk": {"script": "TestScript-Valid.ps1", "executable": "/path/to/executable", "executableArgs": ["-command", "-"], "scriptArgs": ["-warning", "80"]}}
+		}`), 0644)
+
+		os.Args = []string{
+			"main.exe",
+			"-config", configFilePath,
+			"-agent", "web01",
+			"-check", "disk",
+			"-port", "9000",
+			"-executableArg", "-s",
+			"--", "-warning", "90",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, `{"args":["-s"],"path":"/path/to/executable","scriptarguments":["-warning","90"],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
+		assert.Equal(t, "web01:9000", httpClient.RequestHost)
+	})
+
+	t.Run("An unknown agent profile should be an UNKNOWN exit code", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		configFilePath := filepath.Join(t.TempDir(), "mac.yaml")
+		ioutil.WriteFile(configFilePath, []byte("agents: {}\n"), 0644)
+
+		os.Args = []string{
+			"main.exe",
+			"-config", configFilePath,
+			"-agent", "web02",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, `agent "web02" is not defined in the config file`, buf.String())
+	})
+
+	t.Run("The executable and its arguments default to the interpreter profile for the script type", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-script", "TestScript-Valid.ps1",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, `{"args":["-command","-"],"path":"C:\\Windows\\System32\\WindowsPowerShell\\v1.0\\powershell.exe","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
+	})
+
+	t.Run("An explicit interpreter profile overrides the detected one", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-script", "TestScript-Valid.ps1",
+			"-interpreter", "pwsh",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, `{"args":["-command","-"],"path":"pwsh","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
+	})
+
+	t.Run("Scripts without a known type still need an executable", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-script", "README.md",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "executable is not set", buf.String())
+	})
+
+	t.Run("Normalising fixes up powershell scripts instead of rejecting them", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Invalid.ps1",
+			"-normalise",
+			"-line-endings", "crlf",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, `{"args":null,"path":"/path/to/executable","scriptarguments":[],"stdin":"Write-Host \"This is a test script\"\r\n\r\n","timeout":"10s"}`, httpClient.RequestBodyContent)
+	})
+
+	t.Run("Normalising strips the BOM, converts line endings and warns about a trailing here-string", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+		oldStderr := stderr
+		defer func() { stderr = oldStderr }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		var warnings bytes.Buffer
+		stderr = &warnings
+
+		scriptPath := filepath.Join(t.TempDir(), "here-string.ps1")
+		ioutil.WriteFile(scriptPath, []byte("\xef\xbb\xbf$text = @'\nhello\n'@"), 0644)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", scriptPath,
+			"-normalise",
+			"-line-endings", "crlf",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Contains(t, httpClient.RequestBodyContent, `"stdin":"$text = @'\r\nhello\r\n'@\r\n\r\n"`)
+		assert.Equal(t, "warning: "+scriptPath+": the script ends with a here-string, powershell reading from stdin may wait for further input, add a statement after it\n", warnings.String())
+	})
+
+	t.Run("Normalising leaves a signed script unchanged", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+		oldStderr := stderr
+		defer func() { stderr = oldStderr }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		var warnings bytes.Buffer
+		stderr = &warnings
+
+		scriptPath := filepath.Join(t.TempDir(), "signed.ps1")
+		ioutil.WriteFile(scriptPath, []byte("Write-Host \"This is a test script\"\n\n\n"), 0644)
+		ioutil.WriteFile(scriptPath+".minisig", []byte("untrusted comment: signature from minisign secret key\n"), 0644)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", scriptPath,
+			"-normalise",
+			"-line-endings", "crlf",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit, buf.String())
+		assert.Contains(t, httpClient.RequestBodyContent, `"stdin":"Write-Host \"This is a test script\"\n\n\n"`)
+		assert.Equal(t, "warning: "+scriptPath+": not normalised, it would no longer match its signature "+scriptPath+".minisig\n", warnings.String())
+	})
+
+	t.Run("Normalising only pads powershell scripts missing the blank lines", func(t *testing.T) {
+		for _, testCase := range []struct {
+			content       string
+			arguments     []string
+			expectedExit  int
+			expectedStdin string
+		}{
+			{"Write-Host \"x\"", []string{"-normalise"}, 0, `"stdin":"Write-Host \"x\"\n\n"`},
+			{"Write-Host \"x\"\n", []string{"-normalise"}, 0, `"stdin":"Write-Host \"x\"\n\n"`},
+			{"Write-Host \"x\"\r\n", []string{"-normalise"}, 0, `"stdin":"Write-Host \"x\"\r\n\r\n"`},
+			{"Write-Host \"x\"\n\n\n", []string{"-normalise"}, 0, `"stdin":"Write-Host \"x\"\n\n\n"`},
+			{"Write-Host \"x\"\n\n", []string{"-line-endings", "crlf"}, 3, ""},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			scriptPath := filepath.Join(t.TempDir(), "script.ps1")
+			ioutil.WriteFile(scriptPath, []byte(testCase.content), 0644)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", "remotehost",
+				"-username", "thisismyusername",
+				"-password", "thisismypassword",
+				"-executable", "/path/to/executable",
+				"-script", scriptPath,
+			}, testCase.arguments...)
+			httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit, buf.String())
+			if testCase.expectedExit == 0 {
+				assert.Contains(t, httpClient.RequestBodyContent, testCase.expectedStdin)
+			} else {
+				assert.Equal(t, "-line-endings only applies with -normalise", buf.String())
+			}
+		}
+	})
+
+	t.Run("A script matching its signature is sent when a minisign public key is configured", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-script", "TestScript-Signed.pl",
+			"-minisign-pubkey", "TestScript-Signed.pub",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "Test output", buf.String())
+		assert.Contains(t, httpClient.RequestBodyContent, `"stdinsignature":"untrusted comment: signature from minisign secret key\n`)
+	})
+
+	t.Run("A script edited since it was signed should be an UNKNOWN exit code without contacting the agent", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		scriptPath := filepath.Join(t.TempDir(), "TestScript-Signed.pl")
+		ioutil.WriteFile(scriptPath, []byte("#!/usr/bin/perl\n\nprint \"this script was edited\\n\";\n"), 0644)
+		signature, _ := ioutil.ReadFile("TestScript-Signed.pl.minisig")
+		ioutil.WriteFile(scriptPath+".minisig", signature, 0644)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-script", scriptPath,
+			"-minisign-pubkey", "RWRtoG/PXUKxYEO0dOOKdLStWn4V71UtbOLpgAFRHP0a/Ckj6wKUJol/",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "UNKNOWN - signature verification of "+scriptPath+" failed, it has been modified since it was signed or was signed by another key: the signature does not match the content", buf.String())
+		assert.Equal(t, "", httpClient.RequestBodyContent)
+	})
+
+	t.Run("An unsigned script should be an UNKNOWN exit code when a minisign public key is configured", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-minisign-pubkey", "TestScript-Signed.pub",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "UNKNOWN - script TestScript-Valid.ps1 is not signed, TestScript-Valid.ps1.minisig does not exist", buf.String())
+	})
+
+	t.Run("Responses that cannot be decoded should be an UNKNOWN exit code showing the body", func(t *testing.T) {
+		for _, testCase := range []struct {
+			responseBody   string
+			expectedOutput string
+		}{
+			{`<html>Bad Gateway</html>`, "UNKNOWN - could not decode the agent response: invalid character '<' looking for beginning of value\n<html>Bad Gateway</html>"},
+			{`{"exitcode": 0}`, "UNKNOWN - could not decode the agent response: the \"output\" field is missing\n{\"exitcode\": 0}"},
+			{`{"output": "OK", "exitcode": "0"}`, "UNKNOWN - could not decode the agent response: the \"exitcode\" field is invalid: json: cannot unmarshal string into Go value of type int\n{\"output\": \"OK\", \"exitcode\": \"0\"}"},
+			{`{"output": "OK", "exitcode": 0, "stderr": "", "version": "1.2"}`, "UNKNOWN - could not decode the agent response: unknown fields stderr, version, use -response-decoding tolerant to accept them\n{\"output\": \"OK\", \"exitcode\": 0, \"stderr\": \"\", \"version\": \"1.2\"}"},
+			{`{"output": "` + strings.Repeat("x", 250), "UNKNOWN - could not decode the agent response: unexpected EOF\n{\"output\": \"" + strings.Repeat("x", 188) + "..."},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = []string{
+				"main.exe",
+				"-host", "remotehost",
+				"-username", "thisismyusername",
+				"-password", "thisismypassword",
+				"-executable", "/path/to/executable",
+				"-script", "TestScript-Valid.ps1",
+			}
+			httpClient := httpclient.NewMockHTTPClient(testCase.responseBody, 200)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, 3, actualExit)
+			assert.Equal(t, testCase.expectedOutput, buf.String())
+		}
+	})
+
+	t.Run("Tolerant decoding shows the fields a newer agent added in the long output", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-response-decoding", "tolerant",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "WARNING - slow | time=5s\nlong output", "exitcode": 1, "stderr": "deprecated cmdlet\r\n", "duration": 5.02, "version": ""}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 1, actualExit)
+		assert.Equal(t, "WARNING - slow | time=5s\nlong output\nduration: 5.02\nstderr: deprecated cmdlet", buf.String())
+	})
+
+	t.Run("Failures are classified and reported with the configured state", func(t *testing.T) {
+		for _, testCase := range []struct {
+			name           string
+			doFunc         func(*http.Request) (*http.Response, error)
+			responseCode   int
+			responseBody   string
+			expectedExit   int
+			expectedOutput string
+		}{
+			{
+				name:           "authentication failure mapped to critical",
+				responseCode:   401,
+				responseBody:   "Unauthorized",
+				expectedExit:   2,
+				expectedOutput: "CRITICAL - authentication failed (HTTP 401), check the username and password\nUnauthorized",
+			},
+			{
+				name:           "signature rejected",
+				responseCode:   400,
+				responseBody:   "Signature verification failed",
+				expectedExit:   3,
+				expectedOutput: "UNKNOWN - the agent rejected the script signature (HTTP 400)\nSignature verification failed",
+			},
+			{
+				name:           "agent side timeout",
+				responseCode:   500,
+				responseBody:   "script timed out after 10s",
+				expectedExit:   1,
+				expectedOutput: "WARNING - the agent timed out running the script (HTTP 500)\nscript timed out after 10s",
+			},
+			{
+				name:           "server error",
+				responseCode:   500,
+				responseBody:   "internal error",
+				expectedExit:   3,
+				expectedOutput: "UNKNOWN - the agent failed to handle the request (HTTP 500)\ninternal error",
+			},
+			{
+				name: "connection refused",
+				doFunc: func(r *http.Request) (*http.Response, error) {
+					return nil, &url.Error{Op: "Post", URL: r.URL.String(), Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}
+				},
+				expectedExit:   3,
+				expectedOutput: "UNKNOWN - connection to remotehost:9000 refused, check the monitoring agent service is running",
+			},
+			{
+				name: "DNS failure",
+				doFunc: func(r *http.Request) (*http.Response, error) {
+					return nil, &url.Error{Op: "Post", URL: r.URL.String(), Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "remotehost"}}}
+				},
+				expectedExit:   3,
+				expectedOutput: "UNKNOWN - DNS lookup of remotehost failed: no such host",
+			},
+			{
+				name: "TLS verification failure",
+				doFunc: func(r *http.Request) (*http.Response, error) {
+					return nil, &url.Error{Op: "Post", URL: r.URL.String(), Err: x509.UnknownAuthorityError{}}
+				},
+				expectedExit:   3,
+				expectedOutput: "UNKNOWN - TLS verification of remotehost:9000 failed: x509: certificate signed by unknown authority, check -cacert",
+			},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = []string{
+				"main.exe",
+				"-host", "remotehost",
+				"-username", "thisismyusername",
+				"-password", "thisismypassword",
+				"-executable", "/path/to/executable",
+				"-script", "TestScript-Valid.ps1",
+				"-error-state", "auth=critical",
+				"-error-state", "agent-timeout=warning",
+			}
+			httpClient := httpclient.NewMockHTTPClient(testCase.responseBody, testCase.responseCode)
+			if testCase.doFunc != nil {
+				httpClient.DoFunc = testCase.doFunc
+			}
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit, testCase.name)
+			assert.Equal(t, testCase.expectedOutput, buf.String(), testCase.name)
+		}
+	})
+
+	t.Run("Remote exit codes are mapped to Nagios states", func(t *testing.T) {
+		for _, testCase := range []struct {
+			arguments      []string
+			responseBody   string
+			expectedExit   int
+			expectedOutput string
+		}{
+			{nil, `{"output": "Test output", "exitcode": 4}`, 3, "Test output\nthe script exited with code 4 which is not a Nagios state"},
+			{nil, `{"output": "Test output", "exitcode": -1073741510}`, 3, "Test output\nthe script exited with code -1073741510 (0xC000013A) which is not a Nagios state"},
+			{[]string{"-exit-code-map", "4=warning"}, `{"output": "Test output", "exitcode": 4}`, 1, "Test output"},
+			{[]string{"-exit-code-map", "0=warning", "-exit-code-map", "-1073741510=critical"}, `{"output": "Test output", "exitcode": -1073741510}`, 2, "Test output"},
+			{[]string{"-invert", "-prefix-state"}, `{"output": "w3wp.exe is running", "exitcode": 0}`, 2, "CRITICAL - w3wp.exe is running"},
+			{[]string{"-invert", "-prefix-state"}, `{"output": "w3wp.exe is not running", "exitcode": 2}`, 0, "OK - w3wp.exe is not running"},
+			{[]string{"-prefix-state"}, `{"output": "WARNING: disk filling | used=91%", "exitcode": 1}`, 1, "WARNING: disk filling | used=91%"},
+			{[]string{"-invert"}, `{"output": "OK - w3wp.exe is running", "exitcode": 0}`, 2, "CRITICAL - w3wp.exe is running"},
+			{[]string{"-invert", "-prefix-state"}, `{"output": "CRITICAL - w3wp.exe is not running", "exitcode": 2}`, 0, "OK - w3wp.exe is not running"},
+			{[]string{"-exit-code-map", "0=warning"}, `{"output": "ok: disk filling", "exitcode": 0}`, 1, "WARNING: disk filling"},
+			{nil, `{"output": "Unknown processes: 0", "exitcode": 0}`, 0, "Unknown processes: 0"},
+			{nil, `{"output": "Critical services all running", "exitcode": 0}`, 0, "Critical services all running"},
+			{nil, `{"output": "CRITICAL - the script's own choice", "exitcode": 0}`, 0, "CRITICAL - the script's own choice"},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", "remotehost",
+				"-username", "thisismyusername",
+				"-password", "thisismypassword",
+				"-executable", "/path/to/executable",
+				"-script", "TestScript-Valid.ps1",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewMockHTTPClient(testCase.responseBody, 200)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit, testCase.responseBody)
+			assert.Equal(t, testCase.expectedOutput, buf.String(), testCase.responseBody)
+		}
+	})
+
+	t.Run("Client side thresholds raise the state and rewrite the perfdata thresholds", func(t *testing.T) {
+		for _, testCase := range []struct {
+			arguments      []string
+			responseBody   string
+			expectedExit   int
+			expectedOutput string
+		}{
+			{
+				[]string{"-warning", "used=80", "-critical", "used=90"},
+				`{"output": "Disk usage | used=85%;95;98;0;100 free=15%", "exitcode": 0}`,
+				1,
+				"Disk usage | used=85%;80;90;0;100 free=15%\nused=85% breached the warning threshold 80",
+			},
+			{
+				[]string{"-warning", "used=80", "-critical", "used=90", "-critical", "free=10:"},
+				`{"output": "Disk usage | used=95%;;;0;100 free=5%", "exitcode": 1}`,
+				2,
+				"Disk usage | used=95%;80;90;0;100 free=5%;;10:\nused=95% breached the critical threshold 90\nfree=5% breached the critical threshold 10:",
+			},
+			{
+				[]string{"-critical", "used=90"},
+				`{"output": "Disk usage | used=5%", "exitcode": 2}`,
+				2,
+				"Disk usage | used=5%;;90",
+			},
+			{
+				[]string{"-critical", "queue=@5:10"},
+				`{"output": "Queue | length=7", "exitcode": 0}`,
+				3,
+				"Queue | length=7\nno perfdata labelled queue to evaluate the thresholds against",
+			},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", "remotehost",
+				"-username", "thisismyusername",
+				"-password", "thisismypassword",
+				"-executable", "/path/to/executable",
+				"-script", "TestScript-Valid.ps1",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewMockHTTPClient(testCase.responseBody, 200)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit, testCase.responseBody)
+			assert.Equal(t, testCase.expectedOutput, buf.String(), testCase.responseBody)
+		}
+	})
+
+	t.Run("An invalid threshold should be an UNKNOWN exit code", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-warning", "used=90:80",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, `invalid warning threshold for used: invalid range "90:80": start is greater than end`, buf.String())
+	})
+
+	t.Run("Several hosts are checked and aggregated to the worst state with each host in the long output", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		hostsFile := filepath.Join(t.TempDir(), "hosts")
+		ioutil.WriteFile(hostsFile, []byte("# iis nodes\nweb02\n\nweb03:9001\nweb01\n"), 0644)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "web01",
+			"-hosts-file", hostsFile,
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+		}
+		var lock sync.Mutex
+		var contacted []string
+		httpClient := httpclient.NewMockHTTPClient("", 200)
+		httpClient.DoFunc = func(r *http.Request) (*http.Response, error) {
+			lock.Lock()
+			contacted = append(contacted, r.URL.Host)
+			lock.Unlock()
+
+			responses := map[string]string{
+				"web01:9000": `{"output": "OK - hash abc | files=12\nchecked C:\\inetpub", "exitcode": 0}`,
+				"web02:9000": `{"output": "WARNING - hash def", "exitcode": 1}`,
+			}
+			response, found := responses[r.URL.Host]
+			if !found {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+			}
+			return &http.Response{Body: ioutil.NopCloser(strings.NewReader(response)), StatusCode: 200}, nil
+		}
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+		actualOutput := buf.String()
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "UNKNOWN - 3 hosts, 1 OK, 1 WARNING, 1 UNKNOWN | ok=1;;;0;3 warning=1;;;0;3 critical=0;;;0;3 unknown=1;;;0;3\n"+
+			"[OK] web01:9000: OK - hash abc\n"+
+			"  checked C:\\inetpub\n"+
+			"[WARNING] web02:9000: WARNING - hash def\n"+
+			"[UNKNOWN] web03:9001: UNKNOWN - connection to web03:9001 refused, check the monitoring agent service is running", actualOutput)
+		assert.ElementsMatch(t, []string{"web01:9000", "web02:9000", "web03:9001"}, contacted)
+	})
+
+	t.Run("IPv6 hosts are given the port in brackets", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		hostsFile := filepath.Join(t.TempDir(), "hosts")
+		ioutil.WriteFile(hostsFile, []byte("fe80::1\n[fe80::2]\n[fe80::3]:9001\n"), 0644)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "::1",
+			"-hosts-file", hostsFile,
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+		}
+		var lock sync.Mutex
+		var contacted []string
+		httpClient := httpclient.NewMockHTTPClient("", 200)
+		httpClient.DoFunc = func(r *http.Request) (*http.Response, error) {
+			lock.Lock()
+			contacted = append(contacted, r.URL.Host)
+			lock.Unlock()
+			return &http.Response{Body: ioutil.NopCloser(strings.NewReader(`{"output": "OK", "exitcode": 0}`)), StatusCode: 200}, nil
+		}
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit, buf.String())
+		assert.ElementsMatch(t, []string{"[::1]:9000", "[fe80::1]:9000", "[fe80::2]:9000", "[fe80::3]:9001"}, contacted)
+	})
+
+	t.Run("No more hosts than the concurrency limit are contacted at once", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "web01", "-host", "web02", "-host", "web03", "-host", "web04",
+			"-concurrency", "2",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+		}
+		var lock sync.Mutex
+		inFlight, mostInFlight := 0, 0
+		httpClient := httpclient.NewMockHTTPClient("", 200)
+		httpClient.DoFunc = func(r *http.Request) (*http.Response, error) {
+			lock.Lock()
+			inFlight++
+			if inFlight > mostInFlight {
+				mostInFlight = inFlight
+			}
+			lock.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			lock.Lock()
+			inFlight--
+			lock.Unlock()
+			return &http.Response{Body: ioutil.NopCloser(strings.NewReader(`{"output": "OK", "exitcode": 0}`)), StatusCode: 200}, nil
+		}
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.True(t, strings.HasPrefix(buf.String(), "OK - 4 hosts, 4 OK | ok=4;;;0;4"))
+		assert.LessOrEqual(t, mostInFlight, 2)
+	})
+
+	t.Run("Aggregation policies decide the state from the states of the hosts", func(t *testing.T) {
+		responses := map[string]string{
+			"web01:9000": `{"output": "OK - running", "exitcode": 0}`,
+			"web02:9000": `{"output": "CRITICAL - stopped", "exitcode": 2}`,
+		}
+		doFunc := func(r *http.Request) (*http.Response, error) {
+			response, found := responses[r.URL.Host]
+			if !found {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+			}
+			return &http.Response{Body: ioutil.NopCloser(strings.NewReader(response)), StatusCode: 200}, nil
+		}
+
+		for _, testCase := range []struct {
+			arguments    []string
+			expectedExit int
+			expectedLine string
+		}{
+			{[]string{"-host", "web01", "-host", "web02", "-host", "web03", "-aggregate", "worst"}, 2, "CRITICAL - 3 hosts, 1 OK, 1 CRITICAL, 1 UNKNOWN | ok=1;;;0;3 warning=0;;;0;3 critical=1;;;0;3 unknown=1;;;0;3"},
+			{[]string{"-host", "web01", "-host", "web02", "-host", "web03", "-aggregate", "best"}, 0, "OK - 3 hosts, 1 OK, 1 CRITICAL, 1 UNKNOWN | ok=1;;;0;3 warning=0;;;0;3 critical=1;;;0;3 unknown=1;;;0;3"},
+			{[]string{"-host", "web01", "-host", "web02", "-host", "web03", "-aggregate", "atleast:1"}, 0, "OK - 3 hosts, 1 OK, 1 CRITICAL, 1 UNKNOWN, at least 1 OK required | ok=1;;1:;0;3 warning=0;;;0;3 critical=1;;;0;3 unknown=1;;;0;3"},
+			{[]string{"-host", "web01", "-host", "web02", "-host", "web03", "-aggregate", "atleast:2"}, 2, "CRITICAL - 3 hosts, 1 OK, 1 CRITICAL, 1 UNKNOWN, at least 2 OK required | ok=1;;2:;0;3 warning=0;;;0;3 critical=1;;;0;3 unknown=1;;;0;3"},
+			{[]string{"-host", "web01", "-host", "web02", "-host", "web03", "-aggregate", "percent:50"}, 2, "CRITICAL - 3 hosts, 1 OK, 1 CRITICAL, 1 UNKNOWN, at least 50% OK required | ok=1;;2:;0;3 warning=0;;;0;3 critical=1;;;0;3 unknown=1;;;0;3"},
+			{[]string{"-host", "web01", "-host", "web02", "-host", "web03", "-aggregate", "atleast:4"}, 3, "-aggregate atleast:4 needs more OK hosts than the 3 hosts given"},
+			{[]string{"-host", "web02", "-host", "web03", "-aggregate", "best", "-unreachable-state", "warning"}, 1, "WARNING - 2 hosts, 1 WARNING, 1 CRITICAL | ok=0;;;0;2 warning=1;;;0;2 critical=1;;;0;2 unknown=0;;;0;2"},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = []string{
+				"main.exe",
+				"-username", "thisismyusername",
+				"-password", "thisismypassword",
+				"-executable", "/path/to/executable",
+				"-script", "TestScript-Valid.ps1",
+			}
+			os.Args = append(os.Args, testCase.arguments...)
+
+			httpClient := httpclient.NewMockHTTPClient("", 200)
+			httpClient.DoFunc = doFunc
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			firstLine := strings.SplitN(buf.String(), "\n", 2)[0]
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit, strings.Join(testCase.arguments, " "))
+			assert.Equal(t, testCase.expectedLine, firstLine)
+		}
+	})
+
+	t.Run("Executable mode runs the executable with its arguments without a script", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-mode", "executable",
+			"-executable", `C:\Program Files\checks\check_iis.exe`,
+			"-executableArg", "-site",
+			"--", "Default Web Site",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "OK - started", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, `{"args":["-site","Default Web Site"],"path":"C:\\Program Files\\checks\\check_iis.exe","scriptarguments":[],"stdin":"","timeout":"10s"}`, httpClient.RequestBodyContent)
+		assert.Equal(t, "/v1/runscriptstdin", httpClient.RequestURI.Path)
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "OK - started", buf.String())
+	})
+
+	t.Run("Script mode runs a script on the agent with the executable from its extension", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-mode", "script",
+			"-script", `C:\checks\disk.pl`,
+			"--", "-warning", "80",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "OK - 50% used", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, `{"args":["C:\\checks\\disk.pl","-warning","80"],"path":"perl","scriptarguments":[],"stdin":"","timeout":"10s"}`, httpClient.RequestBodyContent)
+		assert.Equal(t, "/v1/runscriptstdin", httpClient.RequestURI.Path)
+		assert.Equal(t, 0, actualExit)
+	})
+
+	t.Run("An agent without the probe endpoint says it is missing", func(t *testing.T) {
+		for _, testCase := range []struct {
+			arguments      []string
+			expectedOutput string
+		}{
+			{[]string{"-probe", "-probe-path", "/v1/status"}, "CRITICAL - the agent has no /v1/status endpoint (HTTP 404), check the agent version provides it\n404 page not found"},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", "remotehost",
+				"-password", "thisismypassword",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewMockHTTPClient("404 page not found", 404)
+
+			var buf bytes.Buffer
+			invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedOutput, buf.String())
+		}
+	})
+
+	t.Run("An unknown mode is rejected", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-password", "thisismypassword",
+			"-mode", "remote",
+			"-script", "TestScript-Valid.ps1",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, `invalid mode "remote", expected stdin, script or executable`, buf.String())
+	})
+
+	t.Run("A probe queries the agent without running anything and reports its version and timings", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-probe",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"version": "1.4.2"}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+		actualOutput := buf.String()
+
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "GET", httpClient.RequestVerb)
+		assert.Equal(t, "/v1/runscriptstdin", httpClient.RequestURI.Path)
+		assert.Equal(t, "", httpClient.RequestBodyContent)
+		assert.Equal(t, "Basic dGhpc2lzbXl1c2VybmFtZTp0aGlzaXNteXBhc3N3b3Jk", httpClient.RequestHeaders["Authorization"][0])
+		assert.Regexp(t, `^OK - agent remotehost:9000 version 1\.4\.2 responded in \S+ \| client_time=[0-9.]+s;;;0 `, actualOutput)
+		assert.Contains(t, actualOutput, "client_response_bytes=20B")
+	})
+
+	t.Run("A probe of the run endpoint is OK when the agent only allows POST there", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-password", "thisismypassword",
+			"-probe",
+		}
+		httpClient := httpclient.NewMockHTTPClient("Method Not Allowed", 405)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		assert.Regexp(t, `^OK - agent remotehost:9000 responded in \S+ \| client_time=`, buf.String())
+	})
+
+	t.Run("A failed probe is CRITICAL unless an error state says otherwise", func(t *testing.T) {
+		for _, testCase := range []struct {
+			arguments      []string
+			expectedExit   int
+			expectedOutput string
+		}{
+			{nil, 2, "CRITICAL - authentication failed (HTTP 401), check the username and password\nUnauthorized"},
+			{[]string{"-error-state", "auth=warning"}, 1, "WARNING - authentication failed (HTTP 401), check the username and password\nUnauthorized"},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", "remotehost",
+				"-password", "thisismypassword",
+				"-probe",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewMockHTTPClient("Unauthorized", 401)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit)
+			assert.Equal(t, testCase.expectedOutput, buf.String())
+		}
+	})
+
+	t.Run("Certificate checks report the agent's chain and the client certificate against the day thresholds", func(t *testing.T) {
+		directory := t.TempDir()
+		caCertificate, caKey, caPath, _ := writeTestCertificate(t, directory, "ca", &x509.Certificate{
+			Subject:               pkix.Name{CommonName: "Test CA"},
+			NotAfter:              time.Now().Add(3650*24*time.Hour + time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}, nil, nil)
+		serverCertificate, serverKey, _, _ := writeTestCertificate(t, directory, "server", &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "agent01"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			NotAfter:    time.Now().Add(20*24*time.Hour + time.Hour),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, caCertificate, caKey)
+		_, _, clientCertificatePath, clientKeyPath := writeTestCertificate(t, directory, "client", &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "nagios"},
+			NotAfter:    time.Now().Add(3*24*time.Hour + time.Hour),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, caCertificate, caKey)
+
+		server := httptest.NewUnstartedServer(http.NotFoundHandler())
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{serverCertificate.Raw, caCertificate.Raw}, PrivateKey: serverKey}}}
+		server.StartTLS()
+		defer server.Close()
+		address := server.Listener.Addr().String()
+
+		for _, testCase := range []struct {
+			arguments    []string
+			expectedExit int
+			expectedText string
+		}{
+			{[]string{"-cacert", caPath}, 1, `WARNING - agent certificate "agent01" expires in 20 days | agent_cert_days=20;30:;7:`},
+			{[]string{"-cacert", caPath, "-cert-warning", "10"}, 0, "OK - certificates of " + address + " valid for 20 days | agent_cert_days=20;10:;7:"},
+			{[]string{"-cacert", caPath, "-certificate", clientCertificatePath, "-key", clientKeyPath}, 2, `CRITICAL - agent certificate "agent01" expires in 20 days, client certificate "nagios" expires in 3 days | agent_cert_days=20;30:;7: client_cert_days=3;30:;7:`},
+			{nil, 2, "CRITICAL - certificate of " + address + " does not validate: x509: certificate signed by unknown authority"},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", address,
+				"-check-certs",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewMockHTTPClient("", 200)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+			lines := strings.Split(buf.String(), "\n")
+
+			assert.Equal(t, testCase.expectedExit, actualExit, buf.String())
+			assert.True(t, strings.HasPrefix(lines[0], testCase.expectedText), buf.String())
+			assert.Contains(t, lines, "agent certificate pin: "+publicKeyPin(serverCertificate))
+			assert.Contains(t, lines, "agent certificate: CN=agent01, SANs: 127.0.0.1, issuer: CN=Test CA, expires "+serverCertificate.NotAfter.UTC().Format("2006-01-02")+" (20 days)")
+			assert.Contains(t, lines, "chain certificate: CN=Test CA, issuer: CN=Test CA, expires "+caCertificate.NotAfter.UTC().Format("2006-01-02")+" (3650 days)")
+		}
+	})
+
+	t.Run("Certificate checks with -tofu compare the agent's key with its known agents entry", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.NotFoundHandler())
+		defer server.Close()
+		address := server.Listener.Addr().String()
+		pin := publicKeyPin(server.Certificate())
+		otherPin := "sha256/n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="
+		knownAgentsPath := filepath.Join(t.TempDir(), "known_agents")
+
+		for _, testCase := range []struct {
+			knownAgents  string
+			expectedExit int
+			expectedText string
+			expectedLine string
+		}{
+			{"", 0, "OK - certificates of " + address + " valid for", address + " is not in " + knownAgentsPath + " yet, the chain was not validated, -tofu is set"},
+			{address + " " + pin + "\n", 0, "OK - certificates of " + address + " valid for", "the certificate matches " + knownAgentsPath + ", the chain was not validated, -tofu is set"},
+			{address + " " + otherPin + "\n", 2, "CRITICAL - the certificate of " + address + " has changed, " + knownAgentsPath + " has " + otherPin + " but the agent presented " + pin + " |", "agent certificate pin: " + pin},
+		} {
+			ioutil.WriteFile(knownAgentsPath, []byte(testCase.knownAgents), 0600)
+
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = []string{
+				"main.exe",
+				"-host", address,
+				"-check-certs",
+				"-tofu",
+				"-known-agents", knownAgentsPath,
+			}
+			httpClient := httpclient.NewMockHTTPClient("", 200)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+			lines := strings.Split(buf.String(), "\n")
+
+			assert.Equal(t, testCase.expectedExit, actualExit, buf.String())
+			assert.True(t, strings.HasPrefix(lines[0], testCase.expectedText), buf.String())
+			assert.Contains(t, lines, testCase.expectedLine)
+		}
+
+		knownAgentsContent, _ := ioutil.ReadFile(knownAgentsPath)
+		assert.Equal(t, address+" "+otherPin+"\n", string(knownAgentsContent))
+	})
+
+	t.Run("Certificate day thresholds are validated and can be 0 in the config file", func(t *testing.T) {
+		configFilePath := filepath.Join(t.TempDir(), "mac.yaml")
+		ioutil.WriteFile(configFilePath, []byte("checks:\n  certs:\n    checkCerts: true\n    certWarning: 0\n    certCritical: 0\n"), 0644)
+
+		for _, testCase := range []struct {
+			arguments      []string
+			expectedOutput string
+		}{
+			{[]string{"-cert-warning", "7", "-cert-critical", "7"}, "-cert-warning 7 must be more than -cert-critical 7, or certificates would never be WARNING"},
+			{[]string{"-cert-warning", "5", "-cert-critical", "10"}, "-cert-warning 5 must be more than -cert-critical 10, or certificates would never be WARNING"},
+			{[]string{"-cert-warning", "10", "-cert-critical", "-1"}, "-cert-warning and -cert-critical cannot be negative"},
+			{[]string{"-config", configFilePath, "-check", "certs"}, "-cert-warning 0 must be more than -cert-critical 0, or certificates would never be WARNING"},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", "remotehost",
+				"-check-certs",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewMockHTTPClient("", 200)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, 3, actualExit)
+			assert.Equal(t, testCase.expectedOutput, buf.String())
+		}
+	})
+
+	t.Run("A pinned public key replaces CA and hostname verification", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"output": "OK - pinned", "exitcode": 0}`))
+		}))
+		defer server.Close()
+		address := server.Listener.Addr().String()
+		pin := publicKeyPin(server.Certificate())
+		unpaddedURLSafePin := pinPrefix + strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimPrefix(pin, pinPrefix)), "=")
+
+		for _, testCase := range []struct {
+			pins           []string
+			expectedExit   int
+			expectedOutput string
+		}{
+			{[]string{"sha256/n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=", pin}, 0, "OK - pinned"},
+			{[]string{unpaddedURLSafePin}, 0, "OK - pinned"},
+			{[]string{"sha256/n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCg=="}, 3, `invalid pin "sha256/n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCg==", expected the base64 encoded SHA-256 hash of the public key`},
+			{[]string{"sha256/n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="}, 3, "UNKNOWN - TLS verification of " + address + " failed: its certificate public key " + pin + " does not match any -pin, check -pin"},
+			{[]string{"n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="}, 3, `invalid pin "n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=", expected sha256/<base64 hash of the public key>`},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = []string{
+				"main.exe",
+				"-host", address,
+				"-password", "thisismypassword",
+				"-executable", "/path/to/executable",
+				"-script", "TestScript-Valid.ps1",
+			}
+			for _, pin := range testCase.pins {
+				os.Args = append(os.Args, "-pin", pin)
+			}
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpclient.NewHTTPClient())
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit)
+			assert.Equal(t, testCase.expectedOutput, buf.String())
+		}
+	})
+
+	t.Run("Trust on first use records the agent's key and rejects a different one afterwards", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"output": "OK - trusted", "exitcode": 0}`))
+		}))
+		defer server.Close()
+		address := server.Listener.Addr().String()
+		pin := publicKeyPin(server.Certificate())
+		knownAgentsPath := filepath.Join(t.TempDir(), "known_agents")
+
+		oldStderr := stderr
+		defer func() { stderr = oldStderr }()
+		var warnings bytes.Buffer
+		stderr = &warnings
+
+		invoke := func() (int, string) {
+			oldArgs := os.Args
+			defer func() { os.Args = oldArgs }()
+
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+			os.Args = []string{
+				"main.exe",
+				"-host", address,
+				"-password", "thisismypassword",
+				"-executable", "/path/to/executable",
+				"-script", "TestScript-Valid.ps1",
+				"-tofu",
+				"-known-agents", knownAgentsPath,
+			}
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpclient.NewHTTPClient())
+			return actualExit, buf.String()
+		}
+
+		actualExit, actualOutput := invoke()
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "OK - trusted", actualOutput)
+		assert.Equal(t, "warning: "+address+" was not known, recorded "+pin+" in "+knownAgentsPath+"\n", warnings.String())
+		knownAgentsContent, _ := ioutil.ReadFile(knownAgentsPath)
+		assert.Equal(t, address+" "+pin+"\n", string(knownAgentsContent))
+
+		warnings.Reset()
+		actualExit, actualOutput = invoke()
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "OK - trusted", actualOutput)
+		assert.Equal(t, "", warnings.String())
+
+		otherPin := "sha256/n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="
+		ioutil.WriteFile(knownAgentsPath, []byte(address+" "+otherPin+"\n"), 0600)
+		actualExit, actualOutput = invoke()
+		assert.Equal(t, 2, actualExit)
+		assert.Equal(t, "CRITICAL - the certificate of "+address+" has changed, "+knownAgentsPath+" has "+otherPin+" but the agent presented "+pin+", remove the entry with the known-agents subcommand if the change is expected", actualOutput)
+	})
+
+	t.Run("TLS versions, cipher suites and curves are applied to the transport", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "10.0.0.5",
+			"-password", "thisismypassword",
+			"-executable", "/path/to/executable",
+			"-script", "TestScript-Valid.ps1",
+			"-tls-min-version", "TLS 1.2",
+			"-tls-max-version", "TLSv1.3",
+			"-tls-ciphers", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"-tls-curves", "x25519,P384",
+			"-servername", "web01.example.com",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 0, actualExit)
+		config := httpClient.Transport.TLSClientConfig
+		assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+		assert.Equal(t, uint16(tls.VersionTLS13), config.MaxVersion)
+		assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, config.CipherSuites)
+		assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP384}, config.CurvePreferences)
+		assert.Equal(t, "web01.example.com", config.ServerName)
+	})
+
+	t.Run("Invalid TLS settings are rejected", func(t *testing.T) {
+		for _, testCase := range []struct {
+			arguments      []string
+			expectedOutput string
+		}{
+			{[]string{"-tls-min-version", "1.4"}, `invalid TLS version "1.4", expected 1.0, 1.1, 1.2 or 1.3`},
+			{[]string{"-tls-min-version", "1.3", "-tls-max-version", "1.2"}, "-tls-min-version 1.3 is above -tls-max-version 1.2"},
+			{[]string{"-tls-ciphers", "TLS_RSA_WITH_RC4_256"}, `unknown cipher suite "TLS_RSA_WITH_RC4_256"`},
+			{[]string{"-tls-curves", "P224"}, `unknown curve "P224", expected X25519, P256, P384 or P521`},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", "remotehost",
+				"-password", "thisismypassword",
+				"-script", "TestScript-Valid.ps1",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, 3, actualExit)
+			assert.Equal(t, testCase.expectedOutput, buf.String())
+		}
+	})
+
+	t.Run("The server name overrides the name verified against the agent's certificate", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"output": "OK - verified", "exitcode": 0}`))
+		}))
+		defer server.Close()
+		address := server.Listener.Addr().String()
+
+		caPath := filepath.Join(t.TempDir(), "ca.pem")
+		ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+		for _, testCase := range []struct {
+			serverName     string
+			expectedExit   int
+			expectedOutput string
+		}{
+			{"example.com", 0, "OK - verified"},
+			{"web01.example.org", 3, "UNKNOWN - TLS verification of " + address + " failed: x509: certificate is valid for example.com, *.example.com, not web01.example.org"},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = []string{
+				"main.exe",
+				"-host", address,
+				"-password", "thisismypassword",
+				"-executable", "/path/to/executable",
+				"-script", "TestScript-Valid.ps1",
+				"-cacert", caPath,
+				"-servername", testCase.serverName,
+			}
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpclient.NewHTTPClient())
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit)
+			assert.Equal(t, testCase.expectedOutput, buf.String())
+		}
+	})
+
+	t.Run("Client certificates are loaded from a passphrase protected PKCS#12 bundle", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"output": "OK - authenticated as ` + r.TLS.PeerCertificates[0].Subject.CommonName + `", "exitcode": 0}`))
+		}))
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		server.StartTLS()
+		defer server.Close()
+
+		directory := t.TempDir()
+		clientCertificate, clientKey, _, _ := writeTestCertificate(t, directory, "nagios", &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "nagios"},
+			NotAfter:    time.Now().Add(24 * time.Hour),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, nil, nil)
+		bundle, err := pkcs12.Encode(rand.Reader, clientKey, clientCertificate, nil, "secret")
+		assert.NoError(t, err)
+		bundlePath := filepath.Join(directory, "nagios.pfx")
+		ioutil.WriteFile(bundlePath, bundle, 0600)
+		wrongPassphrasePath := filepath.Join(directory, "wrong-passphrase")
+		ioutil.WriteFile(wrongPassphrasePath, []byte("wrong\n"), 0600)
+
+		for _, testCase := range []struct {
+			arguments      []string
+			expectedExit   int
+			expectedOutput string
+		}{
+			{[]string{"-key-passphrase-command", "echo secret"}, 0, "OK - authenticated as nagios"},
+			{[]string{"-key-passphrase-file", wrongPassphrasePath}, 3, "error loading certificate pair error decrypting " + bundlePath + ": incorrect passphrase"},
+			{nil, 3, "error loading certificate pair the key is encrypted, set -key-passphrase-file, -key-passphrase-command or MONITORING_AGENT_KEY_PASSPHRASE"},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", server.Listener.Addr().String(),
+				"-password", "thisismypassword",
+				"-script", "TestScript.pl",
+				"-insecure",
+				"-certificate", bundlePath,
+			}, testCase.arguments...)
+			httpClient := httpclient.NewHTTPClient()
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit, buf.String())
+			assert.Equal(t, testCase.expectedOutput, buf.String())
+		}
+	})
+
+	t.Run("Agents are verified against every -cacert and -cadir certificate", func(t *testing.T) {
+		directory := t.TempDir()
+		caDirectory := filepath.Join(directory, "cas")
+		emptyDirectory := filepath.Join(directory, "empty")
+		os.Mkdir(caDirectory, 0755)
+		os.Mkdir(emptyDirectory, 0755)
+
+		caTemplate := func(name string) *x509.Certificate {
+			return &x509.Certificate{
+				Subject:               pkix.Name{CommonName: name},
+				NotAfter:              time.Now().Add(24 * time.Hour),
+				IsCA:                  true,
+				BasicConstraintsValid: true,
+				KeyUsage:              x509.KeyUsageCertSign,
+			}
+		}
+		_, _, oldCAPath, _ := writeTestCertificate(t, caDirectory, "old-ca", caTemplate("Old CA"), nil, nil)
+		newCACertificate, newCAKey, newCAPath, _ := writeTestCertificate(t, caDirectory, "new-ca", caTemplate("New CA"), nil, nil)
+		os.Remove(filepath.Join(caDirectory, "old-ca.key"))
+		os.Remove(filepath.Join(caDirectory, "new-ca.key"))
+		serverCertificate, serverKey, _, _ := writeTestCertificate(t, directory, "server", &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "agent01"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			NotAfter:    time.Now().Add(24 * time.Hour),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, newCACertificate, newCAKey)
+		notACertificatePath := filepath.Join(directory, "not-a-certificate.pem")
+		ioutil.WriteFile(notACertificatePath, []byte("not a certificate\n"), 0644)
+		configFilePath := filepath.Join(directory, "mac.yaml")
+		ioutil.WriteFile(configFilePath, []byte("agents:\n  web01:\n    cacert: ["+oldCAPath+", "+newCAPath+"]\n"), 0644)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"output": "OK - verified", "exitcode": 0}`))
+		}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{serverCertificate.Raw}, PrivateKey: serverKey}}}
+		server.StartTLS()
+		defer server.Close()
+		address := server.Listener.Addr().String()
+
+		for _, testCase := range []struct {
+			arguments      []string
+			expectedExit   int
+			expectedOutput string
+		}{
+			{[]string{"-cacert", oldCAPath, "-cacert", newCAPath}, 0, "OK - verified"},
+			{[]string{"-cadir", caDirectory}, 0, "OK - verified"},
+			{[]string{"-config", configFilePath, "-agent", "web01"}, 0, "OK - verified"},
+			{[]string{"-cacert", newCAPath, "-ca-system"}, 0, "OK - verified"},
+			{[]string{"-cacert", oldCAPath}, 3, "UNKNOWN - TLS verification of " + address + " failed"},
+			{[]string{"-cacert", oldCAPath, "-cacert", notACertificatePath}, 3, "no certificates found in " + notACertificatePath},
+			{[]string{"-cadir", emptyDirectory}, 3, "no certificates found in " + emptyDirectory + ", expected .pem, .crt or .cer files"},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", address,
+				"-password", "thisismypassword",
+				"-script", "TestScript.pl",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewHTTPClient()
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit, buf.String())
+			assert.True(t, strings.HasPrefix(buf.String(), testCase.expectedOutput), buf.String())
+		}
+	})
+
+	t.Run("Trusting the system CA certificates as well is rejected where Go cannot load them", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+		oldAvailable := systemCertPoolAvailable
+		defer func() { systemCertPoolAvailable = oldAvailable }()
+		systemCertPoolAvailable = false
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-password", "thisismypassword",
+			"-script", "TestScript.pl",
+			"-cacert", "cacert.pem",
+			"-ca-system",
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "OK - verified", "exitcode": 0}`, 200)
+
+		var buf bytes.Buffer
+		actualExit := invokeClient(&buf, httpClient)
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "-ca-system is not supported on Windows, leave out -cacert and -cadir to verify against the system's CA certificates", buf.String())
+	})
+
+	t.Run("Passwords are read from a file, stdin or a credential helper", func(t *testing.T) {
+		directory := t.TempDir()
+		passwordPath := filepath.Join(directory, "password")
+		ioutil.WriteFile(passwordPath, []byte("filepassword\n"), 0600)
+		helperPath := filepath.Join(directory, "helper.sh")
+		ioutil.WriteFile(helperPath, []byte("#!/bin/sh\ncat > \"$0.input\"\necho \"$1\" >> \"$0.calls\"\nprintf 'username=helperuser\\npassword=helperpassword\\n'\n"), 0755)
+		emptyHelperPath := filepath.Join(directory, "empty-helper.sh")
+		ioutil.WriteFile(emptyHelperPath, []byte("#!/bin/sh\ncat > /dev/null\n"), 0755)
+
+		oldStdin := stdin
+		defer func() { stdin = oldStdin }()
+		stdin = strings.NewReader("stdinpassword\nnot the password\n")
+
+		for _, testCase := range []struct {
+			arguments      []string
+			expectedExit   int
+			expectedOutput string
+			expectedAuth   string
+		}{
+			{[]string{"-password-file", passwordPath}, 0, "Test output", "thisismyusername:filepassword"},
+			{[]string{"-password-stdin"}, 0, "Test output", "thisismyusername:stdinpassword"},
+			{[]string{"-credential-helper", helperPath}, 0, "Test output", "helperuser:helperpassword"},
+			{[]string{"-credential-helper", emptyHelperPath}, 3, "UNKNOWN - the credential helper did not return a password for remotehost:9000", ""},
+			{[]string{"-password-file", passwordPath, "-credential-helper", helperPath}, 3, "only one of -password, -password-file, -password-stdin and -credential-helper can be set", ""},
+			{nil, 3, "password is not set", ""},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", "remotehost",
+				"-username", "thisismyusername",
+				"-executable", "/path/to/executable",
+				"-script", "TestScript-Valid.ps1",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, testCase.expectedExit, actualExit, buf.String())
+			assert.Equal(t, testCase.expectedOutput, buf.String())
+			if testCase.expectedAuth != "" {
+				assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte(testCase.expectedAuth)), httpClient.RequestHeaders["Authorization"][0])
+			}
+		}
+
+		helperInput, _ := ioutil.ReadFile(helperPath + ".input")
+		assert.Equal(t, "protocol=https\nhost=remotehost\nport=9000\nusername=thisismyusername\n\n", string(helperInput))
+	})
+
+	t.Run("A password given on the command line overrides the environment", func(t *testing.T) {
+		directory := t.TempDir()
+		passwordPath := filepath.Join(directory, "password")
+		ioutil.WriteFile(passwordPath, []byte("filepassword\n"), 0600)
+		helperPath := filepath.Join(directory, "helper.sh")
+		ioutil.WriteFile(helperPath, []byte("#!/bin/sh\ncat > /dev/null\necho password=helperpassword\n"), 0755)
+
+		os.Setenv("MONITORING_AGENT_CREDENTIAL_HELPER", helperPath)
+		defer os.Unsetenv("MONITORING_AGENT_CREDENTIAL_HELPER")
+		os.Setenv("MONITORING_AGENT_PASSWORD_FILE", passwordPath)
+		defer os.Unsetenv("MONITORING_AGENT_PASSWORD_FILE")
+
+		for _, testCase := range []struct {
+			arguments    []string
+			expectedAuth string
+		}{
+			{[]string{"-password", "flagpassword"}, "thisismyusername:flagpassword"},
+			{[]string{"-password-file", passwordPath}, "thisismyusername:filepassword"},
+			{[]string{"-credential-helper", helperPath}, "thisismyusername:helperpassword"},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-host", "remotehost",
+				"-username", "thisismyusername",
+				"-executable", "/path/to/executable",
+				"-script", "TestScript-Valid.ps1",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewMockHTTPClient(`{"output": "Test output", "exitcode": 0}`, 200)
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+
+			assert.Equal(t, 0, actualExit, buf.String())
+			assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte(testCase.expectedAuth)), httpClient.RequestHeaders["Authorization"][0])
+		}
+	})
+
+	t.Run("Agents in the config file have their own credentials by host", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, password, _ := r.BasicAuth()
+			w.Write([]byte(`{"output": "OK - ` + username + `:` + password + `", "exitcode": 0}`))
+		}))
+		defer server.Close()
+		_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+		directory := t.TempDir()
+		helperPath := filepath.Join(directory, "helper.sh")
+		ioutil.WriteFile(helperPath, []byte("#!/bin/sh\ncat > /dev/null\necho password=helperpassword\n"), 0755)
+		configFilePath := filepath.Join(directory, "mac.yaml")
+		ioutil.WriteFile(configFilePath, []byte(`
+agents:
+  first:
+    host: 127.0.0.1
+    username: firstuser
+    password: firstpassword
+  second:
+    host: localhost
+    port: `+port+`
+    username: seconduser
+    credentialHelper: `+helperPath+`
+groups:
+  both: [127.0.0.1, localhost]
+`), 0644)
+
+		for _, testCase := range []struct {
+			arguments     []string
+			expectedLines []string
+		}{
+			{nil, []string{"[OK] 127.0.0.1:" + port + ": OK - firstuser:firstpassword", "[OK] localhost:" + port + ": OK - seconduser:helperpassword"}},
+			{[]string{"-password", "flagpassword"}, []string{"[OK] 127.0.0.1:" + port + ": OK - firstuser:flagpassword", "[OK] localhost:" + port + ": OK - seconduser:flagpassword"}},
+		} {
+			oldArgs := os.Args
+			flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+
+			os.Args = append([]string{
+				"main.exe",
+				"-config", configFilePath,
+				"-group", "both",
+				"-port", port,
+				"-insecure",
+				"-mode", "executable",
+				"-executable", "/usr/bin/id",
+			}, testCase.arguments...)
+			httpClient := httpclient.NewHTTPClient()
+
+			var buf bytes.Buffer
+			actualExit := invokeClient(&buf, httpClient)
+			os.Args = oldArgs
+			lines := strings.Split(buf.String(), "\n")
+
+			assert.Equal(t, 0, actualExit, buf.String())
+			for _, expectedLine := range testCase.expectedLines {
+				assert.Contains(t, lines, expectedLine, buf.String())
+			}
+		}
+	})
+}
+
+func TestTemplateCommand(t *testing.T) {
+	t.Run("The template is written once and only replaced with -force", func(t *testing.T) {
+		templateDirectory := t.TempDir()
+		arguments := []string{"-name", "check_disk", "-directory", templateDirectory}
+
+		var buf bytes.Buffer
+		actualExit := templateCommand(&buf, strings.NewReader("DISK OK | /=2643MB;5948;5958;0;5968"), arguments)
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "template check_disk written to "+templateDirectory+"\n", buf.String())
+
+		buf.Reset()
+		actualExit = templateCommand(&buf, strings.NewReader("DISK OK | /=2643MB;5948;5958;0;5968"), arguments)
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "template check_disk already exists in "+templateDirectory+", use -force to replace it", buf.String())
+
+		buf.Reset()
+		actualExit = templateCommand(&buf, strings.NewReader("DISK OK | /=2643MB;5948;5958;0;5968"), append(arguments, "-force"))
+		assert.Equal(t, 0, actualExit)
+	})
+
+	t.Run("Without a directory the template is printed", func(t *testing.T) {
+		var buf bytes.Buffer
+		actualExit := templateCommand(&buf, strings.NewReader("OK | a=1s b=2s"), []string{"-name", "timings"})
+
+		assert.Equal(t, 0, actualExit)
+		assert.Contains(t, buf.String(), `$ds_name[1] = "s";`)
+		assert.Contains(t, buf.String(), `rrd::line1("var2", "#ff7f0e", "b")`)
+	})
+}
+
+func TestSignCommand(t *testing.T) {
+	t.Run("Scripts signed with a generated key are verified before sending them", func(t *testing.T) {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+
+		directory := t.TempDir()
+		publicKeyPath := filepath.Join(directory, "minisign.pub")
+		secretKeyPath := filepath.Join(directory, "minisign.key")
+		scriptPath := filepath.Join(directory, "check.pl")
+		ioutil.WriteFile(scriptPath, []byte("print \"OK\\n\";\n"), 0644)
+
+		var buf bytes.Buffer
+		actualExit := keygenCommand(&buf, strings.NewReader(""), []string{"-W", "-p", publicKeyPath, "-s", secretKeyPath})
+		assert.Equal(t, 0, actualExit)
+
+		buf.Reset()
+		actualExit = keygenCommand(&buf, strings.NewReader(""), []string{"-W", "-p", publicKeyPath, "-s", secretKeyPath})
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, secretKeyPath+" already exists, use -f to replace it", buf.String())
+
+		buf.Reset()
+		actualExit = signCommand(&buf, strings.NewReader(""), []string{"-s", secretKeyPath, scriptPath})
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "signed "+scriptPath+"\n", buf.String())
+
+		signature, _ := ioutil.ReadFile(scriptPath + ".minisig")
+		assert.Regexp(t, "^untrusted comment: signature from minisign secret key\nRW[A-Za-z0-9+/=]+\ntrusted comment: timestamp:[0-9]+\tfile:check.pl\n[A-Za-z0-9+/=]+\n$", string(signature))
+
+		flag.CommandLine = flag.NewFlagSet("flag", flag.ExitOnError)
+		os.Args = []string{
+			"main.exe",
+			"-host", "remotehost",
+			"-username", "thisismyusername",
+			"-password", "thisismypassword",
+			"-script", scriptPath,
+			"-minisign-pubkey", publicKeyPath,
+		}
+		httpClient := httpclient.NewMockHTTPClient(`{"output": "OK", "exitcode": 0}`, 200)
+
+		buf.Reset()
+		actualExit = invokeClient(&buf, httpClient)
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "OK", buf.String())
+	})
+
+	t.Run("An encrypted key without a password cannot be generated", func(t *testing.T) {
+		directory := t.TempDir()
+
+		var buf bytes.Buffer
+		actualExit := keygenCommand(&buf, strings.NewReader("\n"), []string{"-p", filepath.Join(directory, "minisign.pub"), "-s", filepath.Join(directory, "minisign.key")})
+
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "a password is required to encrypt the secret key, use -W to leave it unencrypted", buf.String())
+	})
+}
+
+func TestKnownAgentsCommand(t *testing.T) {
+	t.Run("Entries can be added, listed and removed", func(t *testing.T) {
+		knownAgentsPath := filepath.Join(t.TempDir(), "known_agents")
+		pin := "sha256/n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="
+
+		var buf bytes.Buffer
+		actualExit := knownAgentsCommand(&buf, strings.NewReader(""), []string{"-file", knownAgentsPath, "add", "web02", pin})
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "added web02:9000 "+pin+" to "+knownAgentsPath+"\n", buf.String())
+
+		knownAgentsCommand(&buf, strings.NewReader(""), []string{"-file", knownAgentsPath, "add", "web01:9001", pin})
+
+		buf.Reset()
+		actualExit = knownAgentsCommand(&buf, strings.NewReader(""), []string{"-file", knownAgentsPath, "list"})
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "web01:9001 "+pin+"\nweb02:9000 "+pin+"\n", buf.String())
+
+		buf.Reset()
+		actualExit = knownAgentsCommand(&buf, strings.NewReader(""), []string{"-file", knownAgentsPath, "remove", "web02"})
+		assert.Equal(t, 0, actualExit)
+		assert.Equal(t, "removed web02:9000 from "+knownAgentsPath+"\n", buf.String())
+
+		buf.Reset()
+		actualExit = knownAgentsCommand(&buf, strings.NewReader(""), []string{"-file", knownAgentsPath, "remove", "web02"})
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, "web02:9000 is not in "+knownAgentsPath, buf.String())
+
+		buf.Reset()
+		actualExit = knownAgentsCommand(&buf, strings.NewReader(""), []string{"-file", knownAgentsPath, "add", "web03", "abc"})
+		assert.Equal(t, 3, actualExit)
+		assert.Equal(t, `invalid pin "abc", expected sha256/<base64 hash of the public key>`, buf.String())
+
+		knownAgentsContent, _ := ioutil.ReadFile(knownAgentsPath)
+		assert.Equal(t, "web01:9001 "+pin+"\n", string(knownAgentsContent))
+	})
+
+	t.Run("The lock waits for other clients and is released with them", func(t *testing.T) {
+		oldTimeout := knownAgentsLockTimeout
+		defer func() { knownAgentsLockTimeout = oldTimeout }()
+		knownAgentsLockTimeout = 100 * time.Millisecond
+
+		knownAgentsPath := filepath.Join(t.TempDir(), "known_agents")
+		unlock, err := lockFile(knownAgentsPath)
+		assert.NoError(t, err)
+
+		_, err = lockFile(knownAgentsPath)
+		assert.EqualError(t, err, "timed out waiting for another client to unlock "+knownAgentsPath+".lock")
+
+		unlock()
+		assert.True(t, FileExists(knownAgentsPath+".lock"))
+		unlockAgain, err := lockFile(knownAgentsPath)
+		assert.NoError(t, err)
+		unlockAgain()
+	})
+}
+
+func TestDetectInterpreterProfile(t *testing.T) {
+	t.Run("The shebang is preferred over the extension", func(t *testing.T) {
+		profile, found := detectInterpreterProfile("check.sh", "#!/usr/bin/env -S python3 -u\nprint('hi')\n")
+		assert.True(t, found)
+		assert.Equal(t, "python", profile.name)
+
+		profile, found = detectInterpreterProfile("TestScript.pl", "#!/perl\n\nprint \"this is a test script\"\n")
+		assert.True(t, found)
+		assert.Equal(t, "perl", profile.name)
+
+		profile, found = detectInterpreterProfile("CHECK.BAT", "@echo off\r\n")
+		assert.True(t, found)
+		assert.Equal(t, "cmd", profile.name)
+
+		_, found = detectInterpreterProfile("check", "echo hi\n")
+		assert.False(t, found)
+	})
 }
+
+// writeTestCertificate creates a certificate signed by parent, or self signed
+// when parent is nil, and writes it and its key to PEM files in directory
+func writeTestCertificate(t *testing.T, directory string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certificatePath := filepath.Join(directory, name+".crt")
+	keyPath := filepath.Join(directory, name+".key")
+	ioutil.WriteFile(certificatePath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certificate, key, certificatePath, keyPath
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const utf8ByteOrderMark = "\xef\xbb\xbf"
+
+var powershellHereStringTerminator = regexp.MustCompile(`^\s*['"]@\s*$`)
+
+func validateLineEndings(lineEndings string) error {
+	switch lineEndings {
+	case "keep", "crlf", "lf":
+		return nil
+	}
+	return fmt.Errorf("invalid line endings %q, expected keep, crlf or lf", lineEndings)
+}
+
+// normaliseScript fixes up a script so it can be fed to its interpreter on
+// stdin, returning the problems it cannot fix as warnings
+func normaliseScript(profile interpreterProfile, scriptContent string, lineEndings string) (string, []string) {
+	normalised := strings.TrimPrefix(scriptContent, utf8ByteOrderMark)
+
+	lineEnding := "\n"
+	switch lineEndings {
+	case "lf":
+		normalised = strings.ReplaceAll(normalised, "\r\n", "\n")
+	case "crlf":
+		normalised = strings.ReplaceAll(strings.ReplaceAll(normalised, "\r\n", "\n"), "\n", "\r\n")
+		lineEnding = "\r\n"
+	default:
+		if strings.Contains(normalised, "\r\n") {
+			lineEnding = "\r\n"
+		}
+	}
+
+	if profile.normalise != nil {
+		normalised = profile.normalise(normalised, lineEnding)
+	}
+
+	var warnings []string
+	if profile.warnings != nil {
+		warnings = profile.warnings(normalised)
+	}
+
+	return normalised, warnings
+}
+
+// normalisePowershell makes sure the script ends with the two blank lines
+// powershell needs to run the last statement read from stdin, a script that
+// already does is left as it is
+func normalisePowershell(scriptContent string, lineEnding string) string {
+	if validatePowershell(scriptContent) == nil {
+		return scriptContent
+	}
+	if strings.HasSuffix(scriptContent, lineEnding) {
+		return scriptContent + lineEnding
+	}
+	return strings.TrimRight(scriptContent, "\r\n") + lineEnding + lineEnding
+}
+
+func powershellWarnings(scriptContent string) []string {
+	lines := strings.Split(strings.TrimRight(scriptContent, "\r\n"), "\n")
+	lastLine := strings.TrimSuffix(lines[len(lines)-1], "\r")
+
+	if powershellHereStringTerminator.MatchString(lastLine) {
+		return []string{"the script ends with a here-string, powershell reading from stdin may wait for further input, add a statement after it"}
+	}
+	return nil
+}
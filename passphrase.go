@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// helperTimeout is how long a passphrase or credential helper command may
+// take, a helper waiting on a prompt nobody will answer must not hang the check
+var helperTimeout = 10 * time.Second
+
+// keyPassphrase is where the passphrase of an encrypted -key or -certificate
+// bundle comes from, it is only read when the key turns out to be encrypted
+type keyPassphrase struct {
+	file    string
+	command string
+}
+
+func (source keyPassphrase) read() ([]byte, error) {
+	switch {
+	case source.file != "":
+		content, err := ioutil.ReadFile(source.file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the key passphrase: %s", err)
+		}
+		return trimLineEnding(content), nil
+	case source.command != "":
+		output, err := runHelper(source.command, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error running -key-passphrase-command: %s", err)
+		}
+		return trimLineEnding(output), nil
+	}
+	if passphrase, found := os.LookupEnv("MONITORING_AGENT_KEY_PASSPHRASE"); found {
+		return []byte(passphrase), nil
+	}
+	return nil, fmt.Errorf("the key is encrypted, set -key-passphrase-file, -key-passphrase-command or MONITORING_AGENT_KEY_PASSPHRASE")
+}
+
+// runHelper runs command through the shell, as git runs its credential
+// helpers, writing input to its stdin and returning what it prints
+func runHelper(command string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), helperTimeout)
+	defer cancel()
+
+	var helper *exec.Cmd
+	if runtime.GOOS == "windows" {
+		helper = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		helper = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	helper.Stdin = bytes.NewReader(input)
+	var stderrOutput bytes.Buffer
+	helper.Stderr = &stderrOutput
+
+	output, err := helper.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%q did not finish within %s", command, helperTimeout)
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderrOutput.String()); message != "" {
+			return nil, fmt.Errorf("%q failed: %s: %s", command, err, message)
+		}
+		return nil, fmt.Errorf("%q failed: %s", command, err)
+	}
+	return output, nil
+}
+
+// trimLineEnding drops the newline editors and echo leave at the end, a
+// passphrase may otherwise start or end with spaces
+func trimLineEnding(content []byte) []byte {
+	return bytes.TrimRight(content, "\r\n")
+}
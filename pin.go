@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const pinPrefix = "sha256/"
+
+// publicKeyPins are the -pin hashes the agent's certificate public key must
+// match one of, keyed by the decoded hash so any base64 spelling matches
+type publicKeyPins map[[sha256.Size]byte]bool
+
+// pinMismatchError is returned from the TLS handshake when the agent's
+// certificate does not match any pin
+type pinMismatchError struct {
+	pin string
+}
+
+func (e pinMismatchError) Error() string {
+	return fmt.Sprintf("certificate public key %s does not match any -pin", e.pin)
+}
+
+func parsePublicKeyPins(values []string) (publicKeyPins, error) {
+	pins := publicKeyPins{}
+	for _, value := range values {
+		hash, err := parsePublicKeyPin(value)
+		if err != nil {
+			return nil, err
+		}
+		pins[hash] = true
+	}
+	return pins, nil
+}
+
+// parsePublicKeyPin decodes a sha256/<base64> pin, padded or not and in
+// either the standard or URL safe alphabet
+func parsePublicKeyPin(value string) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, pinPrefix) {
+		return hash, fmt.Errorf("invalid pin %q, expected %s<base64 hash of the public key>", value, pinPrefix)
+	}
+	encoded := strings.TrimRight(strings.TrimPrefix(value, pinPrefix), "=")
+	for _, encoding := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+		decoded, err := encoding.DecodeString(encoded)
+		if err == nil && len(decoded) == sha256.Size {
+			copy(hash[:], decoded)
+			return hash, nil
+		}
+	}
+	return hash, fmt.Errorf("invalid pin %q, expected the base64 encoded SHA-256 hash of the public key", value)
+}
+
+// samePublicKeyPin compares pins by their hash, however they are encoded
+func samePublicKeyPin(first string, second string) bool {
+	firstHash, firstErr := parsePublicKeyPin(first)
+	secondHash, secondErr := parsePublicKeyPin(second)
+	return firstErr == nil && secondErr == nil && firstHash == secondHash
+}
+
+// formatPublicKeyPin writes a hash the way publicKeyPin does
+func formatPublicKeyPin(hash [sha256.Size]byte) string {
+	return pinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// publicKeyPin is the pin of the certificate's public key, the same hash
+// HPKP used: openssl x509 -pubkey | openssl pkey -pubin -outform der |
+// openssl dgst -sha256 -binary | base64
+func publicKeyPin(certificate *x509.Certificate) string {
+	return formatPublicKeyPin(sha256.Sum256(certificate.RawSubjectPublicKeyInfo))
+}
+
+// verifyPeerCertificate is the tls.Config.VerifyPeerCertificate used when
+// pins are set, only the agent's own certificate is considered as the rest of
+// the chain is not verified
+func (pins publicKeyPins) verifyPeerCertificate(rawCertificates [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCertificates) == 0 {
+		return fmt.Errorf("the agent did not present a certificate")
+	}
+	certificate, err := x509.ParseCertificate(rawCertificates[0])
+	if err != nil {
+		return fmt.Errorf("could not parse the agent's certificate: %s", err)
+	}
+	if !pins[sha256.Sum256(certificate.RawSubjectPublicKeyInfo)] {
+		return pinMismatchError{pin: publicKeyPin(certificate)}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isConnectionRefused reports whether the agent's host refused the connection,
+// Winsock reports it as WSAECONNREFUSED rather than ECONNREFUSED
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, windows.WSAECONNREFUSED)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"monitoring-agent-client/internal/httpclient"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	modeStdin      = "stdin"
+	modeScript     = "script"
+	modeExecutable = "executable"
+)
+
+// runScriptStdinPath is the agent endpoint every -mode is run through, the
+// script and executable modes send an empty stdin with the command in args
+const runScriptStdinPath = "/v1/runscriptstdin"
+
+var modes = map[string]bool{modeStdin: true, modeScript: true, modeExecutable: true}
+
+// agentCheck is everything needed to run the script against an agent and turn
+// the response into plugin output, it is shared by every host of a fan-out so
+// must not be modified by run
+type agentCheck struct {
+	httpClient     httpclient.Interface
+	path           string
+	requestBody    []byte
+	credentials    *credentials
+	timeouts       clientTimeouts
+	errorStates    failureStates
+	tolerant       bool
+	exitCodes      exitCodeMapping
+	thresholds     thresholdRules
+	clientPerfdata bool
+	// probe only checks the agent answers on path, nothing is run
+	probe bool
+}
+
+// hostResult is the plugin output and state of running the check against one
+// host, failure is set when the agent could not run the script
+type hostResult struct {
+	address string
+	output  string
+	state   int
+	failure failureClass
+}
+
+// run sends the request to the agent at address and returns the plugin output
+// and state, failures are rendered in the state configured for their class
+func (check *agentCheck) run(address string) hostResult {
+	url := fmt.Sprintf("https://%s%s", address, check.path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), check.timeouts.total)
+	defer cancel()
+
+	trace := newRequestTrace()
+
+	method := http.MethodPost
+	if check.probe {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(trace.withContext(ctx), method, url, bytes.NewBuffer(check.requestBody))
+	if err != nil {
+		return hostResult{address: address, output: fmt.Sprintf("got http request error %s", err.Error()), state: unknownExitCode}
+	}
+	username, password, err := check.credentials.lookup(address)
+	if err != nil {
+		return check.failed(address, failure{class: failureAuthentication, message: err.Error()})
+	}
+	req.SetBasicAuth(username, password)
+
+	response, err := check.httpClient.Do(req)
+
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return check.failed(address, timeoutFailure("client", check.timeouts.total, address, trace.currentPhase()))
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			phase := trace.currentPhase()
+			return check.failed(address, timeoutFailure(phase.timeoutName(), check.timeouts.forPhase(phase), address, phase))
+		}
+		return check.failed(address, classifyTransportError(err, address))
+	}
+
+	defer response.Body.Close()
+
+	trace.setPhase(phaseReadingBody)
+	responseBodyContent, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return check.failed(address, timeoutFailure("client", check.timeouts.total, address, trace.currentPhase()))
+		}
+		return check.failed(address, failure{class: failureConnection, message: fmt.Sprintf("error reading the response from %s: %s", address, err)})
+	}
+	trace.finish(len(check.requestBody), len(responseBodyContent))
+
+	// the run endpoint only takes POST, the agent answering the probe's GET
+	// with 405 shows it is up
+	if response.StatusCode != 200 && !(check.probe && response.StatusCode == http.StatusMethodNotAllowed) {
+		return check.failed(address, classifyResponse(response.StatusCode, check.path, responseBodyContent))
+	}
+
+	if check.probe {
+		return check.probed(address, responseBodyContent, trace)
+	}
+
+	decodedResponse, err := decodeResponse(responseBodyContent, check.tolerant)
+	if err != nil {
+		return check.failed(address, failure{
+			class:   failureInvalidResponse,
+			message: fmt.Sprintf("could not decode the agent response: %s", err),
+			detail:  responseExcerpt(responseBodyContent),
+		})
+	}
+
+	state, exitCodeNote := check.exitCodes.state(decodedResponse.Exitcode)
+
+	output := appendLongOutput(decodedResponse.Output, decodedResponse.extraOutput())
+	if exitCodeNote != "" {
+		output = appendLongOutput(output, []string{exitCodeNote})
+	}
+	if check.clientPerfdata {
+		output = appendPerfdata(output, trace.perfdata())
+	}
+
+	output, state = check.thresholds.apply(output, state)
+	if state != decodedResponse.Exitcode {
+		output = correctStatePrefix(output, state)
+	}
+	return hostResult{address: address, output: output, state: state}
+}
+
+// failed renders a problem talking to the agent as the host's result
+func (check *agentCheck) failed(address string, problem failure) hostResult {
+	output, state := problem.render(check.errorStates)
+	return hostResult{address: address, output: output, state: state, failure: problem.class}
+}
+
+// probed reports the agent as up, with its version when the response has one,
+// and the request timings as perfdata
+func (check *agentCheck) probed(address string, body []byte, trace *requestTrace) hostResult {
+	var info map[string]interface{}
+	version := ""
+	if json.Unmarshal(body, &info) == nil && info["version"] != nil {
+		version = fmt.Sprintf(" version %v", info["version"])
+	}
+
+	output := fmt.Sprintf("OK - agent %s%s responded in %s", address, version, trace.elapsed().Round(time.Millisecond))
+	output = appendPerfdata(output, trace.perfdata())
+
+	output, state := check.thresholds.apply(output, okExitCode)
+	return hostResult{address: address, output: output, state: state}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const responseExcerptLength = 200
+
+// decodeResponse reads the agent's JSON response. Strict decoding rejects
+// fields it does not know, tolerant decoding keeps them in Extra so a newer
+// agent's additions are shown rather than failing the check. Either way a
+// response without output and exitcode is an error, never an empty OK.
+func decodeResponse(body []byte, tolerant bool) (MonitoringAgentResponse, error) {
+	var fields map[string]json.RawMessage
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&fields); err != nil {
+		return MonitoringAgentResponse{}, err
+	}
+	if decoder.More() {
+		return MonitoringAgentResponse{}, errors.New("unexpected data after the JSON object")
+	}
+
+	var decoded MonitoringAgentResponse
+	for _, required := range []string{"output", "exitcode"} {
+		if _, found := fields[required]; !found {
+			return MonitoringAgentResponse{}, fmt.Errorf("the %q field is missing", required)
+		}
+	}
+	if err := json.Unmarshal(fields["output"], &decoded.Output); err != nil {
+		return MonitoringAgentResponse{}, fmt.Errorf("the %q field is invalid: %s", "output", err)
+	}
+	if err := json.Unmarshal(fields["exitcode"], &decoded.Exitcode); err != nil {
+		return MonitoringAgentResponse{}, fmt.Errorf("the %q field is invalid: %s", "exitcode", err)
+	}
+	delete(fields, "output")
+	delete(fields, "exitcode")
+
+	if len(fields) > 0 {
+		if !tolerant {
+			return MonitoringAgentResponse{}, fmt.Errorf("unknown fields %s, use -response-decoding tolerant to accept them", strings.Join(sortedKeys(fields), ", "))
+		}
+		decoded.Extra = fields
+	}
+
+	return decoded, nil
+}
+
+// extraOutput renders the fields a tolerant decode kept as long output lines
+func (r MonitoringAgentResponse) extraOutput() []string {
+	var lines []string
+	for _, name := range sortedKeys(r.Extra) {
+		var text string
+		if err := json.Unmarshal(r.Extra[name], &text); err != nil {
+			text = string(r.Extra[name])
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", name, strings.TrimRight(text, "\r\n")))
+	}
+	return lines
+}
+
+func responseExcerpt(body []byte) string {
+	if len(body) > responseExcerptLength {
+		return string(body[:responseExcerptLength]) + "..."
+	}
+	return string(body)
+}
+
+func sortedKeys(fields map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// scriptOptions are the flags describing what the agent is asked to run
+type scriptOptions struct {
+	mode              string
+	script            string
+	interpreter       string
+	executable        string
+	executableArgs    []string
+	scriptArguments   []string
+	timeout           string
+	normalise         bool
+	lineEndings       string
+	minisignPublicKey string
+}
+
+// runRequestBody builds the request for the -mode, a script sent on stdin is
+// loaded, normalised, validated and has its signature verified first
+func runRequestBody(options scriptOptions) ([]byte, error) {
+	scriptContent := ""
+	if options.mode == modeStdin {
+		scriptContentByteArray, err := ioutil.ReadFile(options.script)
+		if err != nil {
+			return nil, fmt.Errorf("error, could not load script file: %s\n", err)
+		}
+		scriptContent = string(scriptContentByteArray)
+	}
+
+	profile, profileFound := detectInterpreterProfile(options.script, scriptContent)
+	if options.interpreter != "" {
+		var err error
+		profile, err = findInterpreterProfile(options.interpreter)
+		if err != nil {
+			return nil, err
+		}
+		profileFound = true
+	}
+
+	executable := options.executable
+	executableArgs := options.executableArgs
+	if executable == "" && profileFound {
+		executable = profile.executable
+		if len(executableArgs) == 0 && options.mode == modeStdin {
+			executableArgs = append(executableArgs, profile.executableArgs...)
+		}
+	}
+	if executable == "" {
+		return nil, fmt.Errorf("executable is not set")
+	}
+
+	scriptSignatureFilename := fmt.Sprintf("%s%s", options.script, ".minisig")
+
+	if options.mode != modeStdin {
+		if options.normalise {
+			return nil, fmt.Errorf("-normalise only applies to -mode stdin, the script is not sent to the agent")
+		}
+		scriptSignatureFilename = ""
+	}
+
+	if options.lineEndings != "keep" && !options.normalise {
+		return nil, fmt.Errorf("-line-endings only applies with -normalise")
+	}
+
+	if options.normalise {
+		if err := validateLineEndings(options.lineEndings); err != nil {
+			return nil, err
+		}
+		normalisedContent, warnings := normaliseScript(profile, scriptContent, options.lineEndings)
+		for _, warning := range warnings {
+			fmt.Fprintf(stderr, "warning: %s: %s\n", options.script, warning)
+		}
+		// changing a signed script would fail its verification
+		if normalisedContent != scriptContent && FileExists(scriptSignatureFilename) {
+			fmt.Fprintf(stderr, "warning: %s: not normalised, it would no longer match its signature %s\n", options.script, scriptSignatureFilename)
+			normalisedContent = scriptContent
+		}
+		scriptContent = normalisedContent
+	}
+
+	if options.mode == modeStdin && profileFound && profile.validate != nil {
+		if err := profile.validate(scriptContent); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.minisignPublicKey != "" && options.mode == modeStdin {
+		if err := verifyScriptSignature(options.minisignPublicKey, options.script, scriptContent, scriptSignatureFilename); err != nil {
+			return nil, fmt.Errorf("UNKNOWN - %s", err)
+		}
+	}
+
+	restRequest := map[string]interface{}{
+		"path":            executable,
+		"args":            executableArgs,
+		"stdin":           scriptContent,
+		"scriptarguments": options.scriptArguments,
+		"timeout":         options.timeout,
+	}
+	// the agent only runs what it is given on stdin, so the script on the
+	// agent or the executable's arguments go in args with nothing on stdin
+	switch options.mode {
+	case modeScript:
+		restRequest["args"] = append(append(append([]string{}, executableArgs...), options.script), options.scriptArguments...)
+		restRequest["scriptarguments"] = []string{}
+	case modeExecutable:
+		restRequest["args"] = append(append([]string{}, executableArgs...), options.scriptArguments...)
+		restRequest["scriptarguments"] = []string{}
+	}
+
+	if scriptSignatureFilename != "" && FileExists(scriptSignatureFilename) {
+		scriptSignatureContent, err := ioutil.ReadFile(scriptSignatureFilename)
+		if err != nil {
+			return nil, fmt.Errorf("error loading script signature: %s", err.Error())
+		}
+		restRequest["stdinsignature"] = string(scriptSignatureContent)
+	}
+
+	return json.Marshal(restRequest)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"monitoring-agent-client/internal/minisign"
+	"path/filepath"
+)
+
+// verifyScriptSignature checks the script against its .minisig locally so a
+// script edited since it was signed is caught before the agent rejects it
+func verifyScriptSignature(publicKeyValue string, scriptPath string, scriptContent string, signaturePath string) error {
+	if FileExists(publicKeyValue) {
+		publicKeyContent, err := ioutil.ReadFile(publicKeyValue)
+		if err != nil {
+			return fmt.Errorf("error loading minisign public key: %s", err)
+		}
+		publicKeyValue = string(publicKeyContent)
+	}
+	publicKey, err := minisign.ParsePublicKey(publicKeyValue)
+	if err != nil {
+		return err
+	}
+
+	if !FileExists(signaturePath) {
+		return fmt.Errorf("script %s is not signed, %s does not exist", scriptPath, signaturePath)
+	}
+	signatureContent, err := ioutil.ReadFile(signaturePath)
+	if err != nil {
+		return fmt.Errorf("error loading script signature: %s", err)
+	}
+	signature, err := minisign.ParseSignature(string(signatureContent))
+	if err != nil {
+		return fmt.Errorf("%s: %s", signaturePath, err)
+	}
+
+	if err := publicKey.Verify([]byte(scriptContent), signature); err != nil {
+		return fmt.Errorf("signature verification of %s failed, it has been modified since it was signed or was signed by another key: %s", scriptPath, err)
+	}
+
+	signedFilename := signature.TrustedFilename()
+	if signedFilename != "" && signedFilename != filepath.Base(scriptPath) {
+		return fmt.Errorf("signature %s was made for %s, not %s", signaturePath, signedFilename, filepath.Base(scriptPath))
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"monitoring-agent-client/internal/minisign"
+	"monitoring-agent-client/internal/nagios"
+	"monitoring-agent-client/internal/pnp4nagios"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// subcommands are selected by the first argument, anything else runs a check
+var subcommands = map[string]func(stdout io.Writer, stdin io.Reader, arguments []string) int{
+	"template":     templateCommand,
+	"sign":         signCommand,
+	"keygen":       keygenCommand,
+	"known-agents": knownAgentsCommand,
+}
+
+// templateCommand reads plugin output from stdin and writes a pnp4nagios
+// template for its perfdata, e.g. `check | monitoring-agent-client template -name check_iis -directory /etc/pnp4nagios/templates`
+func templateCommand(stdout io.Writer, stdin io.Reader, arguments []string) int {
+	flags := flag.NewFlagSet("template", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	name := flags.String("name", "", "pnp4nagios template name")
+	directory := flags.String("directory", os.Getenv("MONITORING_AGENT_TEMPLATE_DIRECTORY"), "pnp4nagios templates directory, the template is printed when not set")
+	overwrite := flags.Bool("force", false, "replace an existing template")
+	if err := flags.Parse(arguments); err != nil {
+		return unknownExitCode
+	}
+
+	if *name == "" {
+		return die(stdout, "template name is not set")
+	}
+
+	pluginOutput, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return die(stdout, fmt.Sprintf("error reading plugin output: %s", err))
+	}
+	parsed, err := nagios.ParseOutput(string(pluginOutput))
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+
+	if *directory == "" {
+		fmt.Fprint(stdout, pnp4nagios.GenerateTemplate(*name, parsed.Perfdata))
+		return okExitCode
+	}
+
+	written, err := pnp4nagios.WriteTemplate(*directory, *name, parsed.Perfdata, *overwrite)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+	if !written {
+		return die(stdout, fmt.Sprintf("template %s already exists in %s, use -force to replace it", *name, *directory))
+	}
+	fmt.Fprintf(stdout, "template %s written to %s\n", *name, *directory)
+	return okExitCode
+}
+
+// signCommand writes <script>.minisig for each script, in the same format as
+// `minisign -S` so the agent can verify them
+func signCommand(stdout io.Writer, stdin io.Reader, arguments []string) int {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	secretKeyPath := flags.String("s", "minisign.key", "minisign secret key file")
+	trustedComment := flags.String("t", "", "trusted comment, defaults to the timestamp and file name")
+	prehash := flags.Bool("H", false, "sign a blake2b hash of the script, the agent must support prehashed signatures")
+	if err := flags.Parse(arguments); err != nil {
+		return unknownExitCode
+	}
+
+	if flags.NArg() == 0 {
+		return die(stdout, "no scripts to sign")
+	}
+
+	secretKey, err := loadSecretKey(*secretKeyPath, stdin)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+
+	for _, scriptPath := range flags.Args() {
+		scriptContent, err := ioutil.ReadFile(scriptPath)
+		if err != nil {
+			return die(stdout, fmt.Sprintf("error, could not load script file: %s", err))
+		}
+
+		comment := *trustedComment
+		if comment == "" {
+			comment = fmt.Sprintf("timestamp:%d\tfile:%s", time.Now().Unix(), filepath.Base(scriptPath))
+			if *prehash {
+				comment += "\thashed"
+			}
+		}
+
+		signature := secretKey.Sign(scriptContent, comment, *prehash)
+		if err := ioutil.WriteFile(scriptPath+".minisig", []byte(signature.String()), 0644); err != nil {
+			return die(stdout, fmt.Sprintf("error writing signature: %s", err))
+		}
+		fmt.Fprintf(stdout, "signed %s\n", scriptPath)
+	}
+
+	return okExitCode
+}
+
+// keygenCommand creates a minisign key pair, encrypted with the password
+// unless -W is given
+func keygenCommand(stdout io.Writer, stdin io.Reader, arguments []string) int {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	publicKeyPath := flags.String("p", "minisign.pub", "public key file to write")
+	secretKeyPath := flags.String("s", "minisign.key", "secret key file to write")
+	unencrypted := flags.Bool("W", false, "do not encrypt the secret key with a password")
+	overwrite := flags.Bool("f", false, "replace an existing key pair")
+	if err := flags.Parse(arguments); err != nil {
+		return unknownExitCode
+	}
+
+	if !*overwrite && FileExists(*secretKeyPath) {
+		return die(stdout, fmt.Sprintf("%s already exists, use -f to replace it", *secretKeyPath))
+	}
+
+	var password []byte
+	if !*unencrypted {
+		password = readMinisignPassword(stdin)
+		if len(password) == 0 {
+			return die(stdout, "a password is required to encrypt the secret key, use -W to leave it unencrypted")
+		}
+	}
+
+	publicKey, secretKey, err := minisign.GenerateKey(rand.Reader)
+	if err != nil {
+		return die(stdout, fmt.Sprintf("error generating key: %s", err))
+	}
+	encodedSecretKey, err := secretKey.Encode(rand.Reader, password)
+	if err != nil {
+		return die(stdout, err.Error())
+	}
+
+	if err := ioutil.WriteFile(*secretKeyPath, []byte(encodedSecretKey), 0600); err != nil {
+		return die(stdout, fmt.Sprintf("error writing secret key: %s", err))
+	}
+	encodedPublicKey := fmt.Sprintf("untrusted comment: minisign public key %s\n%s\n", minisign.FormatKeyID(publicKey.KeyID), publicKey)
+	if err := ioutil.WriteFile(*publicKeyPath, []byte(encodedPublicKey), 0644); err != nil {
+		return die(stdout, fmt.Sprintf("error writing public key: %s", err))
+	}
+
+	fmt.Fprintf(stdout, "public key %s written to %s\n", publicKey, *publicKeyPath)
+	return okExitCode
+}
+
+// knownAgentsCommand manages the -tofu known agents file:
+// list, remove <host[:port]> or add <host[:port]> <pin>
+func knownAgentsCommand(stdout io.Writer, stdin io.Reader, arguments []string) int {
+	flags := flag.NewFlagSet("known-agents", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	path := flags.String("file", defaultKnownAgentsPath(), "known agents file")
+	port := flags.Int("port", 9000, "port of hosts given without one")
+	if err := flags.Parse(arguments); err != nil {
+		return unknownExitCode
+	}
+
+	store := &knownAgents{path: *path}
+	action := flags.Arg(0)
+	address := ""
+	if flags.NArg() > 1 {
+		addresses, err := agentAddresses([]string{flags.Arg(1)}, "", *port)
+		if err != nil {
+			return die(stdout, err.Error())
+		}
+		if len(addresses) == 1 {
+			address = addresses[0]
+		}
+	}
+
+	switch {
+	case action == "list" && flags.NArg() == 1:
+		entries, err := store.read()
+		if err != nil {
+			return die(stdout, err.Error())
+		}
+		for _, address := range sortedAddresses(entries) {
+			fmt.Fprintf(stdout, "%s %s\n", address, entries[address])
+		}
+		return okExitCode
+
+	case action == "remove" && flags.NArg() == 2 && address != "":
+		removed := false
+		err := store.update(func(entries map[string]string) error {
+			_, removed = entries[address]
+			delete(entries, address)
+			return nil
+		})
+		if err != nil {
+			return die(stdout, err.Error())
+		}
+		if !removed {
+			return die(stdout, fmt.Sprintf("%s is not in %s", address, *path))
+		}
+		fmt.Fprintf(stdout, "removed %s from %s\n", address, *path)
+		return okExitCode
+
+	case action == "add" && flags.NArg() == 3 && address != "":
+		hash, err := parsePublicKeyPin(flags.Arg(2))
+		if err != nil {
+			return die(stdout, err.Error())
+		}
+		pin := formatPublicKeyPin(hash)
+		err = store.update(func(entries map[string]string) error {
+			entries[address] = pin
+			return nil
+		})
+		if err != nil {
+			return die(stdout, err.Error())
+		}
+		fmt.Fprintf(stdout, "added %s %s to %s\n", address, pin, *path)
+		return okExitCode
+	}
+
+	return die(stdout, "expected list, remove <host[:port]> or add <host[:port]> <pin>")
+}
+
+func loadSecretKey(secretKeyPath string, stdin io.Reader) (minisign.SecretKey, error) {
+	secretKeyContent, err := ioutil.ReadFile(secretKeyPath)
+	if err != nil {
+		return minisign.SecretKey{}, fmt.Errorf("error loading secret key: %s", err)
+	}
+	secretKey, err := minisign.ParseSecretKey(string(secretKeyContent), nil)
+	if err == minisign.ErrPasswordRequired {
+		return minisign.ParseSecretKey(string(secretKeyContent), readMinisignPassword(stdin))
+	}
+	return secretKey, err
+}
+
+// readMinisignPassword takes the password from the environment so it can be
+// scripted, falling back to the first line of stdin
+func readMinisignPassword(stdin io.Reader) []byte {
+	if password := os.Getenv("MONITORING_AGENT_MINISIGN_PASSWORD"); password != "" {
+		return []byte(password)
+	}
+	line, _ := bufio.NewReader(stdin).ReadString('\n')
+	return []byte(strings.TrimRight(line, "\r\n"))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"monitoring-agent-client/internal/compat"
+	"monitoring-agent-client/internal/nagios"
+	"sort"
+	"strings"
+)
+
+// thresholdRules are -warning/-critical ranges keyed by perfdata label,
+// evaluated on the client so alerting can be tuned without re-signing scripts
+type thresholdRules struct {
+	warning  map[string]nagios.Range
+	critical map[string]nagios.Range
+}
+
+func parseThresholdRules(warnings []string, criticals []string) (thresholdRules, error) {
+	rules := thresholdRules{warning: map[string]nagios.Range{}, critical: map[string]nagios.Range{}}
+
+	for _, set := range []struct {
+		name   string
+		values []string
+		ranges map[string]nagios.Range
+	}{
+		{"warning", warnings, rules.warning},
+		{"critical", criticals, rules.critical},
+	} {
+		for _, value := range set.values {
+			label, rangeValue, found := compat.Cut(value, "=")
+			if !found || label == "" {
+				return thresholdRules{}, fmt.Errorf("invalid %s threshold %q, expected label=range", set.name, value)
+			}
+			parsed, err := nagios.ParseRange(rangeValue)
+			if err != nil {
+				return thresholdRules{}, fmt.Errorf("invalid %s threshold for %s: %s", set.name, label, err)
+			}
+			set.ranges[label] = parsed
+		}
+	}
+
+	return rules, nil
+}
+
+func (r thresholdRules) empty() bool {
+	return len(r.warning) == 0 && len(r.critical) == 0
+}
+
+// apply evaluates the rules against the output's perfdata, the state is only
+// ever raised. The perfdata's warn/crit fields are replaced with the rules so
+// graphs show the thresholds that were actually applied.
+func (r thresholdRules) apply(output string, state int) (string, int) {
+	if r.empty() {
+		return output, state
+	}
+
+	parsed, err := nagios.ParseOutput(output)
+	rewrite := err == nil
+
+	var notes []string
+	found := map[string]bool{}
+
+	for index, perfdata := range parsed.Perfdata {
+		warningRange, hasWarning := r.warning[perfdata.Label]
+		criticalRange, hasCritical := r.critical[perfdata.Label]
+		if !hasWarning && !hasCritical {
+			continue
+		}
+		found[perfdata.Label] = true
+
+		if hasWarning {
+			parsed.Perfdata[index].Warning = warningRange.String()
+		}
+		if hasCritical {
+			parsed.Perfdata[index].Critical = criticalRange.String()
+		}
+
+		value, err := perfdata.Number()
+		if err != nil {
+			continue
+		}
+		switch {
+		case hasCritical && criticalRange.Alerts(value):
+			state = worstState(state, criticalExitCode)
+			notes = append(notes, fmt.Sprintf("%s=%s%s breached the critical threshold %s", perfdata.Label, perfdata.Value, perfdata.UOM, criticalRange))
+		case hasWarning && warningRange.Alerts(value):
+			state = worstState(state, warningExitCode)
+			notes = append(notes, fmt.Sprintf("%s=%s%s breached the warning threshold %s", perfdata.Label, perfdata.Value, perfdata.UOM, warningRange))
+		}
+	}
+
+	var missing []string
+	for _, ranges := range []map[string]nagios.Range{r.warning, r.critical} {
+		for label := range ranges {
+			if !found[label] && !contains(missing, label) {
+				missing = append(missing, label)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		state = worstState(state, unknownExitCode)
+		notes = append(notes, fmt.Sprintf("no perfdata labelled %s to evaluate the thresholds against", strings.Join(missing, ", ")))
+	}
+
+	if !rewrite {
+		return appendLongOutput(output, notes), state
+	}
+	parsed.LongOutput = append(parsed.LongOutput, notes...)
+	return parsed.String(), state
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
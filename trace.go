@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"monitoring-agent-client/internal/nagios"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+type requestPhase string
+
+const (
+	phaseDial             requestPhase = "dial"
+	phaseTLS              requestPhase = "TLS handshake"
+	phaseAwaitingResponse requestPhase = "awaiting response"
+	phaseReadingBody      requestPhase = "reading body"
+)
+
+type clientTimeouts struct {
+	connect  time.Duration
+	tls      time.Duration
+	response time.Duration
+	total    time.Duration
+}
+
+// forPhase returns the transport timeout that fires while the request is in
+// the given phase, reading the body is only bounded by the total deadline
+func (t clientTimeouts) forPhase(phase requestPhase) time.Duration {
+	switch phase {
+	case phaseDial:
+		return t.connect
+	case phaseTLS:
+		return t.tls
+	case phaseAwaitingResponse:
+		if t.response != 0 {
+			return t.response
+		}
+	}
+	return t.total
+}
+
+func (p requestPhase) timeoutName() string {
+	switch p {
+	case phaseDial:
+		return "connect"
+	case phaseTLS:
+		return "TLS"
+	case phaseAwaitingResponse:
+		return "response"
+	}
+	return "client"
+}
+
+// requestTrace records how far a request got and when each step happened,
+// the transport callbacks run on their own goroutines so every access goes
+// through the mutex
+type requestTrace struct {
+	mutex sync.Mutex
+	phase requestPhase
+
+	started       time.Time
+	dnsStart      time.Time
+	dnsDone       time.Time
+	connectStart  time.Time
+	connectDone   time.Time
+	tlsStart      time.Time
+	tlsDone       time.Time
+	wroteRequest  time.Time
+	firstByte     time.Time
+	finished      time.Time
+	requestBytes  int
+	responseBytes int
+}
+
+func newRequestTrace() *requestTrace {
+	return &requestTrace{phase: phaseDial, started: time.Now()}
+}
+
+func (t *requestTrace) record(timestamp *time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	*timestamp = time.Now()
+}
+
+func (t *requestTrace) finish(requestBytes int, responseBytes int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.finished = time.Now()
+	t.requestBytes = requestBytes
+	t.responseBytes = responseBytes
+}
+
+// elapsed is the time from starting the request to reading the whole response
+func (t *requestTrace) elapsed() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.finished.Sub(t.started)
+}
+
+func (t *requestTrace) setPhase(phase requestPhase) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.phase = phase
+}
+
+func (t *requestTrace) currentPhase() requestPhase {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.phase
+}
+
+func (t *requestTrace) withContext(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			t.setPhase(phaseDial)
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			t.record(&t.dnsStart)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			t.record(&t.dnsDone)
+		},
+		ConnectStart: func(network, addr string) {
+			t.record(&t.connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.record(&t.connectDone)
+		},
+		TLSHandshakeStart: func() {
+			t.setPhase(phaseTLS)
+			t.record(&t.tlsStart)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.record(&t.tlsDone)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.setPhase(phaseAwaitingResponse)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			t.record(&t.wroteRequest)
+		},
+		GotFirstResponseByte: func() {
+			t.record(&t.firstByte)
+		},
+	})
+}
+
+// perfdata reports the timings of a finished request, steps that did not
+// happen (e.g. DNS for an IP address) are reported as zero so the graphs keep
+// the same data sources on every check
+func (t *requestTrace) perfdata() []nagios.Perfdata {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return []nagios.Perfdata{
+		secondsPerfdata("client_time", t.started, t.finished),
+		secondsPerfdata("client_dns_time", t.dnsStart, t.dnsDone),
+		secondsPerfdata("client_connect_time", t.connectStart, t.connectDone),
+		secondsPerfdata("client_tls_time", t.tlsStart, t.tlsDone),
+		secondsPerfdata("client_server_time", t.wroteRequest, t.firstByte),
+		{Label: "client_request_bytes", Value: fmt.Sprint(t.requestBytes), UOM: "B", Min: "0"},
+		{Label: "client_response_bytes", Value: fmt.Sprint(t.responseBytes), UOM: "B", Min: "0"},
+	}
+}
+
+func secondsPerfdata(label string, start time.Time, end time.Time) nagios.Perfdata {
+	elapsed := time.Duration(0)
+	if !start.IsZero() && end.After(start) {
+		elapsed = end.Sub(start)
+	}
+	return nagios.Perfdata{Label: label, Value: fmt.Sprintf("%.6f", elapsed.Seconds()), UOM: "s", Min: "0"}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"monitoring-agent-client/internal/identity"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// parseTLSVersion reads 1.0 to 1.3, optionally written as TLS 1.2 or
+// TLSv1.2, an empty version leaves Go's default
+func parseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	number := strings.TrimPrefix(strings.TrimSpace(name), "TLS")
+	version, found := tlsVersions[strings.TrimPrefix(strings.TrimSpace(number), "v")]
+	if !found {
+		return 0, fmt.Errorf("invalid TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	return version, nil
+}
+
+// tlsVersionName names a TLS version for the output, e.g. TLS 1.2
+func tlsVersionName(version uint16) string {
+	for name, known := range tlsVersions {
+		if known == version {
+			return "TLS " + name
+		}
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// parseCipherSuites reads a comma separated list of Go's cipher suite names,
+// e.g. TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+func parseCipherSuites(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(list, ",") {
+		id, found := known[strings.TrimSpace(name)]
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite %q", strings.TrimSpace(name))
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// parseCurves reads a comma separated list of X25519, P256, P384 and P521
+func parseCurves(list string) ([]tls.CurveID, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var curves []tls.CurveID
+	for _, name := range strings.Split(list, ",") {
+		curve, found := tlsCurves[strings.ToUpper(strings.TrimSpace(name))]
+		if !found {
+			return nil, fmt.Errorf("unknown curve %q, expected X25519, P256, P384 or P521", strings.TrimSpace(name))
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+// transportSettings are the connection and TLS flags shared by every mode
+type transportSettings struct {
+	timeouts               clientTimeouts
+	insecure               bool
+	caCertificateFilePaths []string
+	caDirectory            string
+	// caSystem adds the CA certificates to the system roots rather than
+	// replacing them
+	caSystem            bool
+	certificateFilePath string
+	privateKeyFilePath  string
+	keyPassphrase       keyPassphrase
+	serverName          string
+	minVersion          uint16
+	maxVersion          uint16
+	cipherSuites        []uint16
+	curvePreferences    []tls.CurveID
+	// pins replace CA and hostname verification when set
+	pins publicKeyPins
+	// knownAgents replaces CA and hostname verification with trust on first
+	// use when set
+	knownAgents *knownAgents
+}
+
+// newTransport builds the transport used to contact the agents
+func newTransport(settings transportSettings) (*http.Transport, error) {
+	transport := new(http.Transport)
+	transport.DialContext = (&net.Dialer{Timeout: settings.timeouts.connect}).DialContext
+	transport.TLSHandshakeTimeout = settings.timeouts.tls
+	transport.ResponseHeaderTimeout = settings.timeouts.response
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: settings.insecure,
+		ServerName:         settings.serverName,
+		MinVersion:         settings.minVersion,
+		MaxVersion:         settings.maxVersion,
+		CipherSuites:       settings.cipherSuites,
+		CurvePreferences:   settings.curvePreferences,
+	}
+
+	if len(settings.pins) > 0 {
+		transport.TLSClientConfig.InsecureSkipVerify = true
+		transport.TLSClientConfig.VerifyPeerCertificate = settings.pins.verifyPeerCertificate
+	}
+
+	if settings.certificateFilePath != "" && (settings.privateKeyFilePath != "" || identity.IsPKCS12(settings.certificateFilePath)) {
+		var certificateToLoad tls.Certificate
+		var err error
+		if identity.IsPKCS12(settings.certificateFilePath) {
+			certificateToLoad, err = identity.LoadPKCS12(settings.certificateFilePath, settings.keyPassphrase.read)
+		} else {
+			certificateToLoad, err = identity.LoadKeyPair(settings.certificateFilePath, settings.privateKeyFilePath, settings.keyPassphrase.read)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error loading certificate pair %s", err.Error())
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{certificateToLoad}
+	}
+
+	caCertificates, err := caCertificatePool(settings.caCertificateFilePaths, settings.caDirectory, settings.caSystem)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig.RootCAs = caCertificates
+
+	if settings.knownAgents != nil {
+		dialer := &net.Dialer{Timeout: settings.timeouts.connect}
+		config := transport.TLSClientConfig
+		transport.DialTLSContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return settings.knownAgents.dialTLS(ctx, dialer, config, settings.timeouts.tls, network, address)
+		}
+	}
+
+	return transport, nil
+}